@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/atharvamhaske/tcpie/internals/bench"
+)
+
+// runBench is the bench subcommand, it loads a running server and prints throughput and latency percentiles:
+//
+//	tcpie bench -addr localhost:8080 -c 50 -d 10s
+func runBench(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:8080", "host:port of the server to load")
+	path := flags.String("path", "/", "path every request is sent to")
+	connections := flags.Int("c", 10, "concurrent connections")
+	duration := flags.Duration("d", 10*time.Second, "how long to send requests for")
+	timeout := flags.Duration("timeout", 5*time.Second, "deadline of each request")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	fmt.Fprintf(out, "sending requests to %s%s over %d connections for %s\n", *addr, *path, *connections, *duration)
+	result, err := bench.Run(bench.Options{
+		Addr:        *addr,
+		Path:        *path,
+		Connections: *connections,
+		Duration:    *duration,
+		Timeout:     *timeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "requests   %d in %s, %.1f req/s\n", result.Requests, result.Elapsed.Round(time.Millisecond), result.Throughput())
+	fmt.Fprintf(out, "errors     %d\n", result.Errors)
+	for _, status := range slices.Sorted(maps.Keys(result.Statuses)) {
+		fmt.Fprintf(out, "status %d %d\n", status, result.Statuses[status])
+	}
+	fmt.Fprintf(out, "latency    p50 %s  p90 %s  p99 %s  max %s\n",
+		result.Percentile(50), result.Percentile(90), result.Percentile(99), result.Percentile(100))
+	return nil
+}
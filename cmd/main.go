@@ -2,22 +2,449 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	server "github.com/atharvamhaske/tcpie/internals"
 	"github.com/atharvamhaske/tcpie/internals/config"
 	"github.com/atharvamhaske/tcpie/internals/metrics"
+	ratelimiter "github.com/atharvamhaske/tcpie/internals/rate-limiter"
+	"github.com/atharvamhaske/tcpie/internals/tracing"
+	"github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/parsers/toml/v2"
 	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/env"
+	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/rawbytes"
 	"github.com/knadh/koanf/v2"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func main() {
-	//load all configs using koanf
+// build details, set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// how long in-flight requests get to finish once a shutdown signal is received
+const shutdownTimeout = 10 * time.Second
+
+// how long a graceful restart waits for the new process to report it is ready
+const restartTimeout = 10 * time.Second
+
+// environment variables starting with this prefix override config values
+const envPrefix = "TCPIE_"
+
+// envKey maps an environment variable to its koanf key. The first "_" after the prefix
+// separates the section and "__" marks further nesting, everything else is kept as is:
+//
+//	TCPIE_SERVER_PORT             -> server.port
+//	TCPIE_SERVER_QUEUE_SIZE       -> server.queue_size
+//	TCPIE_SERVER_TLS__CERT_FILE   -> server.tls.cert_file
+//	TCPIE_PROMETHEUS_METRICS_PORT -> prometheus.metrics_port
+func envKey(s string) string {
+	key := strings.ToLower(strings.TrimPrefix(s, envPrefix))
+	section, rest, _ := strings.Cut(key, "_")
+	return section + "." + strings.ReplaceAll(rest, "__", ".")
+}
+
+// config keys holding lists, their environment variables take comma separated values
+var listKeys = map[string]bool{
+	"server.listen":              true,
+	"server.allowed_methods":     true,
+	"server.allow_cidrs":         true,
+	"server.deny_cidrs":          true,
+	"prometheus.known_paths":     true,
+	"prometheus.latency_buckets": true,
+}
+
+// envValue maps an environment variable to its koanf key and value, splitting the values of list keys
+func envValue(s, value string) (string, any) {
+	key := envKey(s)
+	if listKeys[key] {
+		return key, strings.Split(value, ",")
+	}
+	return key, value
+}
+
+// command line flags which override a single config value, mapped to their koanf key
+var overrideFlags = map[string]string{
+	"port":       "server.port",
+	"workers":    "server.workers",
+	"queue-size": "server.queue_size",
+	"url":        "server.url",
+}
+
+// flagOverrides returns the config values of the override flags set on the command line,
+// flags left out don't override anything even though they have a zero default
+func flagOverrides() map[string]any {
+	overrides := make(map[string]any)
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := overrideFlags[f.Name]; ok {
+			overrides[key] = f.Value.(flag.Getter).Get()
+		}
+	})
+	return overrides
+}
+
+// parserFor picks the koanf parser matching the extension of the config file at path,
+// files without an extension are read as yaml like the embedded config
+func parserFor(path string) (koanf.Parser, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", "":
+		return yaml.Parser(), nil
+	case ".json":
+		return json.Parser(), nil
+	case ".toml":
+		return toml.Parser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q, use .yaml, .yml, .json or .toml", ext)
+	}
+}
+
+// keys which moved, a config file or env variable still using the old key sets the new one
+var movedKeys = map[string]string{
+	"server.read_timeout":            "server.timeouts.read",
+	"server.write_timeout":           "server.timeouts.write",
+	"server.idle_timeout":            "server.timeouts.idle",
+	"server.handler_timeout":         "server.timeouts.handler",
+	"server.max_connection_duration": "server.timeouts.max_connection",
+}
+
+// loadLayer loads one config source on top of k. Moved keys are renamed within the source,
+// so the new key set in an earlier source can't win over the old key set in a later one
+func loadLayer(k *koanf.Koanf, provider koanf.Provider, parser koanf.Parser) error {
+	layer := koanf.New(".")
+	if err := layer.Load(provider, parser); err != nil {
+		return err
+	}
+	for old, key := range movedKeys {
+		if !layer.Exists(old) {
+			continue
+		}
+		slog.Warn("deprecated config key, use the new one", "key", old, "new_key", key)
+		if !layer.Exists(key) {
+			layer.Set(key, layer.Get(old))
+		}
+		layer.Delete(old)
+	}
+	return k.Merge(layer)
+}
+
+// loadConfig loads the embedded config as the baseline, layers the config file at path on top
+// (so an external file only needs the settings it changes), then TCPIE_ env variables and
+// finally the values of command line flags in overrides
+func loadConfig(path string, overrides map[string]any) (*koanf.Koanf, error) {
 	k := koanf.New(".")
 	if err := k.Load(rawbytes.Provider(bytes.TrimSpace(config.ConfigFile)), yaml.Parser()); err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		parser, err := parserFor(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := loadLayer(k, file.Provider(path), parser); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+	}
+
+	if err := loadLayer(k, env.ProviderWithValue(envPrefix, ".", envValue), nil); err != nil {
+		return nil, fmt.Errorf("loading env: %w", err)
+	}
+
+	for key, value := range overrides {
+		if err := k.Set(key, value); err != nil {
+			return nil, fmt.Errorf("applying flag for %s: %w", key, err)
+		}
+	}
+	return k, nil
+}
+
+// newLogger builds the slog logger described by cfg, the level lives in a LevelVar so it can change at runtime
+func newLogger(cfg config.LogConfig, level *slog.LevelVar) (*slog.Logger, error) {
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return nil, fmt.Errorf("log.level: %w", err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.Format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("log.format must be text or json, got %q", cfg.Format)
+	}
+}
+
+// newAccessLog opens the access log configured by cfg.AccessLog, nil when it is off. The returned
+// func closes the file behind it and is never nil
+func newAccessLog(cfg config.ServerConfig) (*server.AccessLog, func() error, error) {
+	noClose := func() error { return nil }
+
+	var out io.Writer
+	closeFile := noClose
+	switch cfg.AccessLog {
+	case "", "off":
+		return nil, noClose, nil
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, noClose, fmt.Errorf("server.access_log: %w", err)
+		}
+		out, closeFile = f, f.Close
+	}
+
+	accessLog, err := server.NewAccessLog(out, cfg.AccessLogFormat)
+	if err != nil {
+		closeFile()
+		return nil, noClose, err
+	}
+	return accessLog, closeFile, nil
+}
+
+// serverOptions maps the server config onto the options of the server package, the
+// logger, tracer and metrics are runtime objects and are passed separately
+func serverOptions(serverCfg config.ServerConfig, logCfg config.LogConfig, promCfg config.PromethuesConfig) server.ServerOpts {
+	return server.ServerOpts{
+		MaxThreads: serverCfg.Workers,
+		MinWorkers: serverCfg.MinWorkers,
+		QueueSize:  serverCfg.QueueSize,
+		Rate:       int64(serverCfg.TokenRate),
+		Tokens:     int64(serverCfg.TokenLimit),
+
+		WorkerIdleTimeout: serverCfg.WorkerIdleTimeout,
+
+		RateLimitAlgorithm:  serverCfg.Algorithm,
+		RateLimitStartEmpty: serverCfg.StartEmpty,
+		RateLimitRedis: ratelimiter.RedisOptions{
+			Addr:      serverCfg.Redis.Addr,
+			Password:  serverCfg.Redis.Password,
+			DB:        serverCfg.Redis.DB,
+			KeyPrefix: serverCfg.Redis.KeyPrefix,
+			FailOpen:  serverCfg.Redis.FailurePolicy != "closed",
+			Timeout:   serverCfg.Redis.Timeout,
+		},
+
+		ReadBufferSize:  serverCfg.ReadBufferSize,
+		MaxRequestBytes: serverCfg.MaxRequestBytes,
+		MaxHeaderBytes:  serverCfg.MaxHeaderBytes,
+		TLSCertFile:     serverCfg.TLS.CertFile,
+		TLSKeyFile:      serverCfg.TLS.KeyFile,
+		TLSMinVersion:   serverCfg.TLS.MinVersion,
+
+		Network:       serverCfg.Network,
+		ReusePort:     serverCfg.ReusePort,
+		ProxyProtocol: serverCfg.ProxyProtocol,
+		ExtraListen:   serverCfg.Listen,
+
+		TCPDelay:           !serverCfg.TCPNoDelay,
+		TCPKeepAlivePeriod: serverCfg.TCPKeepAlivePeriod,
+		ListenBacklog:      serverCfg.ListenBacklog,
+
+		PerIPRate:        int64(serverCfg.PerIPRate),
+		PerIPTokens:      int64(serverCfg.PerIPLimit),
+		PerIPIdleTimeout: serverCfg.PerIPIdleTimeout,
+		QueueFullTimeout: serverCfg.QueueFullTimeout,
+		OverflowPolicy:   serverCfg.OverflowPolicy,
+		KeepAlive:        serverCfg.KeepAlive,
+		DrainTimeout:     serverCfg.DrainTimeout,
+		PreShutdownDelay: serverCfg.PreShutdownDelay,
+		MaxConnections:   serverCfg.MaxConnections,
+		AcceptRate:       int64(serverCfg.AcceptRate),
+		LogSampleRate:    logCfg.SampleRate,
+		MetricPaths:      promCfg.KnownPaths,
+		Handler:          responseHandler(serverCfg),
+		AllowedMethods:   serverCfg.AllowedMethods,
+		Auth:             server.AuthOptions(serverCfg.Auth),
+		Overload:         server.OverloadOptions(serverCfg.Overload),
+		Timeouts:         server.Timeouts(serverCfg.Timeouts),
+
+		RateLimitResponse: server.RejectResponse(serverCfg.RateLimitedResponse),
+		BusyResponse:      server.RejectResponse(serverCfg.BusyResponse),
+		RouteLimits:       routeLimits(serverCfg.RouteLimits),
+
+		ResponseDelay:       serverCfg.ResponseDelay,
+		ResponseDelayJitter: serverCfg.ResponseDelayJitter,
+
+		MaxWorkersPerCPU: serverCfg.MaxWorkersPerCPU,
+
+		AcceptLoops: serverCfg.AcceptLoops,
+
+		MaxConnectionsPerIP: serverCfg.MaxConnectionsPerIP,
+
+		AllowCIDRs: serverCfg.AllowCIDRs,
+		DenyCIDRs:  serverCfg.DenyCIDRs,
+
+		ServerHeader: serverCfg.ServerHeader,
+
+		RequestIDHeader: serverCfg.RequestIDHeader,
+
+		MinReadRate:      serverCfg.MinReadRate,
+		MinReadRateGrace: serverCfg.MinReadRateGrace,
+
+		ResetRate:            serverCfg.ResetRate,
+		ResetWithoutResponse: serverCfg.ResetWithoutResponse,
+
+		Compression:         serverCfg.Compression,
+		CompressionMinBytes: serverCfg.CompressionMinBytes,
+
+		ForceStatus: serverCfg.ForceStatus,
+		ErrorRate:   serverCfg.ErrorRate,
+	}
+}
+
+// responseHandler picks the handler for the configured response mode, nil keeps the Hello world default.
+// static_dir is handled by main, opening the directory can fail
+func responseHandler(cfg config.ServerConfig) server.Handler {
+	switch {
+	case cfg.Echo:
+		return server.EchoHandler
+	case cfg.ResponseSizeBytes > 0:
+		return server.FixedSizeHandler(cfg.ResponseSizeBytes)
+	}
+	return nil
+}
+
+// routeLimits converts the configured route limits to server options
+func routeLimits(cfg []config.RouteLimit) []server.RouteLimit {
+	routes := make([]server.RouteLimit, 0, len(cfg))
+	for _, route := range cfg {
+		routes = append(routes, server.RouteLimit{Pattern: route.Path, Rate: int64(route.Rate), Tokens: int64(route.Limit)})
+	}
+	return routes
+}
+
+// server settings a SIGHUP reload applies, changing any other server setting needs a restart
+var reloadableKeys = map[string]bool{
+	"workers":     true,
+	"token_rate":  true,
+	"token_limit": true,
+}
+
+// restartRequired lists the keys of server settings which differ between cur and next but can't be reloaded
+func restartRequired(cur, next config.ServerConfig) []string {
+	var keys []string
+	curValue, nextValue := reflect.ValueOf(cur), reflect.ValueOf(next)
+	for i := 0; i < curValue.NumField(); i++ {
+		key := curValue.Type().Field(i).Tag.Get("koanf")
+		if reloadableKeys[key] {
+			continue
+		}
+		if !reflect.DeepEqual(curValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			keys = append(keys, "server."+key)
+		}
+	}
+	return keys
+}
+
+// reloadConfig re-reads the config from path, flags in overrides still win, and applies what can change while running: the worker
+// count, the global rate limit and the log level. cur and curLog are updated with what was applied.
+// When the new config doesn't load or validate nothing is applied and the error is returned
+func reloadConfig(path string, overrides map[string]any, cur *config.ServerConfig, curLog *config.LogConfig, level *slog.LevelVar, srv *server.Server) error {
+	k, err := loadConfig(path, overrides)
+	if err != nil {
+		return err
+	}
+
+	var serverCfg config.ServerConfig
+	if err := k.Unmarshal("server", &serverCfg); err != nil {
+		return fmt.Errorf("unmarshaling server config: %w", err)
+	}
+	if err := serverCfg.Validate(); err != nil {
+		return fmt.Errorf("invalid server config: %w", err)
+	}
+
+	var logCfg config.LogConfig
+	if err := k.Unmarshal("log", &logCfg); err != nil {
+		return fmt.Errorf("unmarshaling log config: %w", err)
+	}
+	newLevel := slog.LevelInfo
+	if logCfg.Level != "" {
+		if err := newLevel.UnmarshalText([]byte(logCfg.Level)); err != nil {
+			return fmt.Errorf("log.level: %w", err)
+		}
+	}
+
+	restart := restartRequired(*cur, serverCfg)
+	if logCfg.Format != curLog.Format {
+		restart = append(restart, "log.format")
+	}
+	if logCfg.SampleRate != curLog.SampleRate {
+		restart = append(restart, "log.sample_rate")
+	}
+	for _, key := range restart {
+		slog.Warn("config change needs a restart to take effect", "key", key)
+	}
+
+	if serverCfg.Workers != cur.Workers {
+		if err := srv.Resize(serverCfg.Workers); err != nil {
+			return fmt.Errorf("resizing worker pool: %w", err)
+		}
+		cur.Workers = serverCfg.Workers
+	}
+	if serverCfg.TokenRate != cur.TokenRate || serverCfg.TokenLimit != cur.TokenLimit {
+		if err := srv.SetRateLimit(int64(serverCfg.TokenRate), int64(serverCfg.TokenLimit)); err != nil {
+			return fmt.Errorf("replacing rate limiter: %w", err)
+		}
+		cur.TokenRate, cur.TokenLimit = serverCfg.TokenRate, serverCfg.TokenLimit
+	}
+	level.Set(newLevel)
+	curLog.Level = logCfg.Level
+
+	slog.Info("config reloaded", "workers", cur.Workers, "token_rate", cur.TokenRate,
+		"token_limit", cur.TokenLimit, "log_level", newLevel.String())
+	return nil
+}
+
+func main() {
+	// tcpie bench loads a server instead of running one
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("bench failed: %v", err)
+		}
+		return
+	}
+
+	configPath := flag.String("config", "", "path to a yaml, json or toml config file, defaults to the embedded config")
+	flag.Int("port", 0, "port to listen on, overrides server.port")
+	flag.Int("workers", 0, "number of workers, overrides server.workers")
+	flag.Int("queue-size", 0, "jobs queued when all workers are busy, overrides server.queue_size")
+	flag.String("url", "", "address to listen on, overrides server.url")
+	showVersion := flag.Bool("version", false, "print the version, git commit and build date, then exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Printf("tcpie %s (commit %s, built %s, %s)\n", version, commit, buildDate, runtime.Version())
+		return
+	}
+	overrides := flagOverrides()
+
+	//load all configs using koanf
+	k, err := loadConfig(*configPath, overrides)
+	if err != nil {
 		log.Fatalf("error while loading config: %v", err)
 	}
 
@@ -26,15 +453,68 @@ func main() {
 		log.Fatalf("error unmarshaling server config: %v", err)
 	}
 
+	if err := serverCfg.Validate(); err != nil {
+		log.Fatalf("invalid server config: %v", err)
+	}
+
+	var logCfg config.LogConfig
+	if err := k.Unmarshal("log", &logCfg); err != nil {
+		log.Fatalf("error unmarshaling log config: %v", err)
+	}
+
+	logLevel := new(slog.LevelVar)
+	logger, err := newLogger(logCfg, logLevel)
+	if err != nil {
+		log.Fatalf("invalid log config: %v", err)
+	}
+	// the standard log package goes through the same handler from here on
+	slog.SetDefault(logger)
+
+	accessLog, closeAccessLog, err := newAccessLog(serverCfg)
+	if err != nil {
+		log.Fatalf("invalid access log config: %v", err)
+	}
+
+	var staticHandler server.Handler
+	if serverCfg.StaticDir != "" {
+		if staticHandler, err = server.StaticHandler(serverCfg.StaticDir); err != nil {
+			log.Fatalf("invalid static_dir: %v", err)
+		}
+	}
+
 	var promCfg config.PromethuesConfig
 	if err := k.Unmarshal("prometheus", &promCfg); err != nil {
 		log.Fatalf("error unmarshaling prometheus config: %v", err)
 	}
+	if err := promCfg.Validate(serverCfg.Auth); err != nil {
+		log.Fatalf("invalid prometheus config: %v", err)
+	}
+
+	var tracingCfg config.TracingConfig
+	if err := k.Unmarshal("tracing", &tracingCfg); err != nil {
+		log.Fatalf("error unmarshaling tracing config: %v", err)
+	}
+
+	// without tracing the workers get no tracer and skip spans entirely
+	var tracer trace.Tracer
+	var tracerProvider *tracing.Provider
+	if tracingCfg.Enabled {
+		tracerProvider, err = tracing.NewProvider(context.Background(), tracing.Options{
+			Endpoint:    tracingCfg.Endpoint,
+			Insecure:    tracingCfg.Insecure,
+			ServiceName: tracingCfg.ServiceName,
+			SampleRatio: tracingCfg.SampleRatio,
+		})
+		if err != nil {
+			log.Fatalf("failed to set up tracing: %v", err)
+		}
+		tracer = tracerProvider.Tracer()
+	}
 
 	serverURL := serverCfg.URL
 	if parsedURL, err := url.Parse(serverCfg.URL); err == nil {
 		if parsedURL.Host != "" {
-			serverURL = parsedURL.Host
+			serverURL = parsedURL.Hostname()
 		} else if parsedURL.Scheme != "" {
 
 			//if URL is like "http://localhost", extract just "localhost"
@@ -42,8 +522,7 @@ func main() {
 		}
 	}
 
-	log.Printf("starting the server on %s:%d", serverURL, serverCfg.Port)
-
+	log.Printf("tcpie %s (commit %s, built %s)", version, commit, buildDate)
 	// Get metrics endpoint and port from Prometheus config
 	var metricsEndpoint string
 	metricsPort := promCfg.MetricsPort
@@ -55,23 +534,95 @@ func main() {
 		metricsEndpoint = "/metrics"
 	}
 
-	exporter := metrics.NewExportMetrics(metricsPort, metricsEndpoint)
-	opts := server.ServerOpts{
-		MaxThreads: serverCfg.Workers,
-		QueueSize:  serverCfg.QueueSize,
-		Rate:       int64(serverCfg.TokenRate),
-		Tokens:     int64(serverCfg.TokenLimit),
+	exporter := metrics.NewExportMetrics(metricsPort, metricsEndpoint, promCfg.LatencyBuckets)
+	exporter.Metrics.BuildInfo.WithLabelValues(version, commit, buildDate, runtime.Version()).Set(1)
+	cfg := server.Config{URL: serverURL, Port: serverCfg.Port, ServerOpts: serverOptions(serverCfg, logCfg, promCfg)}
+	cfg.Tracer = tracer
+	cfg.AccessLog = accessLog
+	if staticHandler != nil {
+		cfg.Handler = staticHandler
+	}
+
+	exporter.Pprof = promCfg.EnablePprof
+	if promCfg.OnMainPort {
+		cfg.ExporterHandler = exporter.Handler()
+		cfg.ExporterPaths = exporter.Paths()
+		cfg.ExporterDebugPaths = exporter.DebugPaths()
 	}
 
-	// Create server using NewServer (initializes all components)
-	serverObject, err := server.NewServer(serverURL, serverCfg.Port, opts, exporter.Metrics)
+	// the server shares the exporter metrics so they show up on its endpoint
+	serverObject, err := server.New(cfg, server.WithLogger(logger), server.WithMetrics(exporter.Metrics))
 	if err != nil {
 		log.Fatalf("failed to create server: %v", err)
 	}
 
-	go exporter.ExportMetrics()
+	// with port 0 the system picked the port, the listener knows which
+	log.Printf("starting the server on %s", serverObject.Addr())
+
+	exporter.Ready = serverObject.Ready
+	exporter.Drain = serverObject.Drain
+	if server.Restarted() {
+		// the old process keeps the metrics port until it has drained
+		exporter.BindTimeout = shutdownTimeout + serverCfg.PreShutdownDelay + restartTimeout
+	}
+	if !promCfg.OnMainPort {
+		go func() {
+			// the server keeps running without metrics rather than going down with the exporter
+			if err := exporter.ExportMetrics(); err != nil {
+				slog.Error("metrics exporter stopped, serving without metrics", "err", err)
+			}
+		}()
+	}
 	log.Println("server and metrics exporter starting...")
 
-	// Start the TCP server (which blocks)
-	serverObject.Start()
+	// Start the TCP server, it returns once the listener is closed by Shutdown
+	go serverObject.Start()
+
+	// the listeners exist, a parent waiting in Restart can start draining
+	if err := server.NotifyReady(); err != nil {
+		slog.Error("failed to notify the restarting process", "err", err)
+	}
+
+	// SIGHUP reloads the config, a failed reload keeps running with the current one.
+	// A restart signal hands the listeners to a new process and then shuts down like SIGTERM
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, restartSignals...)...)
+	var sig os.Signal
+	for sig == nil {
+		sig = <-sigChan
+		switch {
+		case sig == syscall.SIGHUP:
+			if err := reloadConfig(*configPath, overrides, &serverCfg, &logCfg, logLevel, serverObject); err != nil {
+				slog.Error("config reload failed, keeping the current config", "err", err)
+			}
+			sig = nil
+		case slices.Contains(restartSignals, sig):
+			if err := serverObject.Restart(restartTimeout); err != nil {
+				slog.Error("graceful restart failed, this process keeps serving", "err", err)
+				sig = nil
+			}
+		}
+	}
+	log.Printf("received %s, shutting down server", sig)
+
+	// the lame duck delay comes on top of the time in-flight requests get
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout+serverCfg.PreShutdownDelay)
+	defer cancel()
+
+	if err := serverObject.Shutdown(ctx); err != nil {
+		log.Fatalf("graceful shutdown failed: %v", err)
+	}
+	// metrics stay up while the server drains, so the drain itself can be scraped
+	if err := exporter.Shutdown(ctx); err != nil {
+		slog.Error("failed to stop the metrics exporter", "err", err)
+	}
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			slog.Error("failed to flush spans", "err", err)
+		}
+	}
+	if err := closeAccessLog(); err != nil {
+		slog.Error("failed to close the access log", "err", err)
+	}
+	log.Println("server stopped")
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnvValue(t *testing.T) {
+	tests := []struct {
+		env       string
+		value     string
+		wantKey   string
+		wantValue any
+	}{
+		{env: "TCPIE_SERVER_PORT", value: "9000", wantKey: "server.port", wantValue: "9000"},
+		{env: "TCPIE_SERVER_QUEUE_SIZE", value: "10", wantKey: "server.queue_size", wantValue: "10"},
+		{env: "TCPIE_SERVER_TLS__CERT_FILE", value: "cert.pem", wantKey: "server.tls.cert_file", wantValue: "cert.pem"},
+		{env: "TCPIE_PROMETHEUS_METRICS_PORT", value: "9091", wantKey: "prometheus.metrics_port", wantValue: "9091"},
+		{env: "TCPIE_SERVER_ALLOWED_METHODS", value: "GET,POST", wantKey: "server.allowed_methods", wantValue: []string{"GET", "POST"}},
+		{env: "TCPIE_SERVER_DENY_CIDRS", value: "10.0.0.0/8", wantKey: "server.deny_cidrs", wantValue: []string{"10.0.0.0/8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			key, value := envValue(tt.env, tt.value)
+			if key != tt.wantKey || !reflect.DeepEqual(value, tt.wantValue) {
+				t.Errorf("envValue(%q, %q) = %q, %#v, want %q, %#v", tt.env, tt.value, key, value, tt.wantKey, tt.wantValue)
+			}
+		})
+	}
+}
+
+// every layer wins over the ones before it: embedded config < file < env < flags
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string //yaml config file, empty loads no file
+		env         map[string]string
+		overrides   map[string]any
+		wantPort    int
+		wantWorkers int
+		wantRead    string
+	}{
+		{name: "embedded", wantPort: 8080, wantWorkers: 2, wantRead: "3s"},
+		{name: "file over embedded", file: "server:\n  port: 9000\n", wantPort: 9000, wantWorkers: 2, wantRead: "3s"},
+		{
+			name:     "env over file",
+			file:     "server:\n  port: 9000\n  workers: 4\n",
+			env:      map[string]string{"TCPIE_SERVER_PORT": "9100"},
+			wantPort: 9100, wantWorkers: 4, wantRead: "3s",
+		},
+		{
+			name:      "flag over env",
+			file:      "server:\n  port: 9000\n",
+			env:       map[string]string{"TCPIE_SERVER_PORT": "9100", "TCPIE_SERVER_WORKERS": "6"},
+			overrides: map[string]any{"server.port": 9200},
+			wantPort:  9200, wantWorkers: 6, wantRead: "3s",
+		},
+		{name: "moved key in file", file: "server:\n  read_timeout: 7s\n", wantPort: 8080, wantWorkers: 2, wantRead: "7s"},
+		{
+			name:     "moved key in env over new key in file",
+			file:     "server:\n  timeouts:\n    read: 7s\n",
+			env:      map[string]string{"TCPIE_SERVER_READ_TIMEOUT": "9s"},
+			wantPort: 8080, wantWorkers: 2, wantRead: "9s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			k, err := loadConfig(path, tt.overrides)
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if got := k.Int("server.port"); got != tt.wantPort {
+				t.Errorf("server.port = %d, want %d", got, tt.wantPort)
+			}
+			if got := k.Int("server.workers"); got != tt.wantWorkers {
+				t.Errorf("server.workers = %d, want %d", got, tt.wantWorkers)
+			}
+			if got := k.String("server.timeouts.read"); got != tt.wantRead {
+				t.Errorf("server.timeouts.read = %q, want %q", got, tt.wantRead)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "os"
+
+// graceful restarts pass listener fds to the new process, which this platform doesn't support
+var restartSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SIGUSR2 hands the listeners to a new process and drains this one
+var restartSignals = []os.Signal{syscall.SIGUSR2}
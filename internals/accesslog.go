@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// formats which can be passed to NewAccessLog by name
+const (
+	CommonLogFormat   = `%h - - %t "%r" %s %b`
+	CombinedLogFormat = `%h - - %t "%r" %s %b "%{Referer}i" "%{User-Agent}i"`
+)
+
+// AccessLog writes one line per served request, in a format built from Apache style directives:
+//
+//	%h  client ip            %t  time the request started, [02/Jan/2006:15:04:05 -0700]
+//	%r  request line         %m  method
+//	%U  path                 %q  query string with its ?, empty without one
+//	%s  status               %b  body bytes, - for none
+//	%B  body bytes, 0 for none
+//	%D  duration in microseconds
+//	%T  duration in seconds  %{Name}i  request header Name, - when missing
+//	%%  a literal %
+type AccessLog struct {
+	mu    sync.Mutex //one Write per line, so lines of concurrent workers don't interleave
+	out   io.Writer
+	parts []logPart
+}
+
+// accessEntry is what the worker knows about a request once its response is written
+type accessEntry struct {
+	remoteAddr net.Addr
+	req        *http.Request
+	status     int
+	bytes      int
+	start      time.Time
+	duration   time.Duration
+}
+
+// logPart appends one piece of a log line, either literal text or a directive
+type logPart func(b []byte, e accessEntry) []byte
+
+// NewAccessLog returns an access log writing to out. format is a directive string, "common" or
+// "combined", empty means common. An unknown directive is an error
+func NewAccessLog(out io.Writer, format string) (*AccessLog, error) {
+	switch format {
+	case "", "common":
+		format = CommonLogFormat
+	case "combined":
+		format = CombinedLogFormat
+	}
+
+	parts, err := parseLogFormat(format)
+	if err != nil {
+		return nil, fmt.Errorf("access log format %q: %w", format, err)
+	}
+	return &AccessLog{out: out, parts: parts}, nil
+}
+
+// parseLogFormat compiles format into the parts of a line
+func parseLogFormat(format string) ([]logPart, error) {
+	var parts []logPart
+	for format != "" {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			i = len(format)
+		}
+		if i > 0 {
+			parts = append(parts, literal(format[:i]))
+			format = format[i:]
+			continue
+		}
+		if len(format) < 2 {
+			return nil, fmt.Errorf("trailing %%")
+		}
+
+		if format[1] == '{' {
+			end := strings.Index(format, "}i")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %%{...}i in %q", format)
+			}
+			parts = append(parts, headerPart(format[2:end]))
+			format = format[end+2:]
+			continue
+		}
+
+		part, ok := logDirectives[format[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown directive %%%c", format[1])
+		}
+		parts = append(parts, part)
+		format = format[2:]
+	}
+	return parts, nil
+}
+
+var logDirectives = map[byte]logPart{
+	'%': literal("%"),
+	'h': func(b []byte, e accessEntry) []byte {
+		if host, _, err := net.SplitHostPort(e.remoteAddr.String()); err == nil {
+			return append(b, host...)
+		}
+		return append(b, e.remoteAddr.String()...)
+	},
+	't': func(b []byte, e accessEntry) []byte {
+		return e.start.AppendFormat(append(b, '['), "02/Jan/2006:15:04:05 -0700]")
+	},
+	'r': func(b []byte, e accessEntry) []byte {
+		return append(b, e.req.Method+" "+e.req.RequestURI+" "+e.req.Proto...)
+	},
+	'm': func(b []byte, e accessEntry) []byte { return append(b, e.req.Method...) },
+	'U': func(b []byte, e accessEntry) []byte { return append(b, e.req.URL.Path...) },
+	'q': func(b []byte, e accessEntry) []byte {
+		if e.req.URL.RawQuery == "" {
+			return b
+		}
+		return append(append(b, '?'), e.req.URL.RawQuery...)
+	},
+	's': func(b []byte, e accessEntry) []byte { return strconv.AppendInt(b, int64(e.status), 10) },
+	'b': func(b []byte, e accessEntry) []byte {
+		if e.bytes == 0 {
+			return append(b, '-')
+		}
+		return strconv.AppendInt(b, int64(e.bytes), 10)
+	},
+	'B': func(b []byte, e accessEntry) []byte { return strconv.AppendInt(b, int64(e.bytes), 10) },
+	'D': func(b []byte, e accessEntry) []byte { return strconv.AppendInt(b, e.duration.Microseconds(), 10) },
+	'T': func(b []byte, e accessEntry) []byte { return strconv.AppendFloat(b, e.duration.Seconds(), 'f', 3, 64) },
+}
+
+func literal(s string) logPart {
+	return func(b []byte, e accessEntry) []byte { return append(b, s...) }
+}
+
+func headerPart(name string) logPart {
+	return func(b []byte, e accessEntry) []byte {
+		value := e.req.Header.Get(name)
+		if value == "" {
+			return append(b, '-')
+		}
+		return append(b, value...)
+	}
+}
+
+// log writes the line for e, a failed write is dropped since the response already went out
+func (l *AccessLog) log(e accessEntry) {
+	line := make([]byte, 0, 128)
+	for _, part := range l.parts {
+		line = part(line, e)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
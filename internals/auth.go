@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthOptions gates the server behind an Authorization header. A bearer token, basic
+// credentials or both can be set, with neither every request is let through
+type AuthOptions struct {
+	BearerToken string
+	Username    string
+	Password    string
+	Realm       string //sent in the WWW-Authenticate challenge, defaults to tcpie
+}
+
+func (a AuthOptions) enabled() bool {
+	return a.BearerToken != "" || a.Username != ""
+}
+
+// requireAuth answers requests without valid credentials with 401 and a WWW-Authenticate
+// challenge for every configured scheme
+func requireAuth(auth AuthOptions) Middleware {
+	if !auth.enabled() {
+		return passThrough
+	}
+	if auth.Realm == "" {
+		auth.Realm = "tcpie"
+	}
+
+	var challenges []string
+	if auth.Username != "" {
+		challenges = append(challenges, fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, auth.Realm))
+	}
+	if auth.BearerToken != "" {
+		challenges = append(challenges, fmt.Sprintf(`Bearer realm=%q`, auth.Realm))
+	}
+	challenge := map[string]string{"WWW-Authenticate": strings.Join(challenges, ", ")}
+
+	return func(next Handler) Handler {
+		return func(req *http.Request) (int, map[string]string, []byte) {
+			if !auth.authorized(req) {
+				return http.StatusUnauthorized, challenge, []byte("Unauthorized\n")
+			}
+			return next(req)
+		}
+	}
+}
+
+// authorized checks the Authorization header of req against the configured credentials,
+// comparisons are constant time so they don't leak how much of a secret matched
+func (a AuthOptions) authorized(req *http.Request) bool {
+	if a.Username != "" {
+		if user, pass, ok := req.BasicAuth(); ok {
+			userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.Username))
+			passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Password))
+			return userOK&passOK == 1
+		}
+	}
+
+	if a.BearerToken != "" {
+		// the scheme is case insensitive
+		scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return subtle.ConstantTimeCompare([]byte(token), []byte(a.BearerToken)) == 1
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package bench
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Options configures a load run against a tcpie server, or any HTTP/1.1 server
+type Options struct {
+	Addr        string        //host:port of the server
+	Path        string        //request path, defaults to /
+	Connections int           //connections sending requests at the same time, defaults to 1
+	Duration    time.Duration //how long requests are sent for
+	Timeout     time.Duration //deadline of each request, from writing it until the response body is read, defaults to 5s
+}
+
+// Result is what a run measured, latencies only cover requests which got a response
+type Result struct {
+	Requests  int64         //requests answered, whatever the status
+	Errors    int64         //requests which failed with a connection or protocol error
+	Statuses  map[int]int64 //responses per status code
+	Elapsed   time.Duration
+	latencies []time.Duration //sorted
+}
+
+// Throughput returns the answered requests per second
+func (r Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency p percent of the answered requests stayed within, p is
+// from 0 to 100. It is 0 when no request was answered
+func (r Result) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p / 100)
+	return r.latencies[min(max(i, 0), len(r.latencies)-1)]
+}
+
+// conn is one client connection, it reconnects whenever the server closes the previous one
+type conn struct {
+	opts    Options
+	request []byte
+
+	netConn net.Conn
+	reader  *bufio.Reader
+
+	latencies []time.Duration
+	statuses  map[int]int64
+	errors    int64
+}
+
+// Run sends requests over opts.Connections connections until opts.Duration is over. A connection
+// sends its next request once the previous response is read, so the load follows the server's pace
+func Run(opts Options) (Result, error) {
+	if opts.Addr == "" {
+		return Result{}, errors.New("bench: no address to send requests to")
+	}
+	if opts.Duration <= 0 {
+		return Result{}, fmt.Errorf("bench: duration must be positive, got %s", opts.Duration)
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.Connections <= 0 {
+		opts.Connections = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	request := fmt.Appendf(nil, "GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: tcpie-bench\r\n\r\n", opts.Path, opts.Addr)
+
+	start := time.Now()
+	deadline := start.Add(opts.Duration)
+	conns := make([]*conn, opts.Connections)
+	var wg sync.WaitGroup
+	for i := range conns {
+		conns[i] = &conn{opts: opts, request: request, statuses: make(map[int]int64)}
+		wg.Go(func() { conns[i].run(deadline) })
+	}
+	wg.Wait()
+
+	// every connection kept its own numbers, merged once they are done
+	result := Result{Statuses: make(map[int]int64), Elapsed: time.Since(start)}
+	for _, c := range conns {
+		result.Errors += c.errors
+		result.latencies = append(result.latencies, c.latencies...)
+		for status, n := range c.statuses {
+			result.Statuses[status] += n
+		}
+	}
+	result.Requests = int64(len(result.latencies))
+	slices.Sort(result.latencies)
+	return result, nil
+}
+
+// backoff bounds after failed requests, a server that is down or refusing connections
+// would otherwise have every connection spin on dialing it
+const (
+	minRetryDelay = 10 * time.Millisecond
+	maxRetryDelay = time.Second
+)
+
+// run sends requests one after the other until deadline
+func (c *conn) run(deadline time.Time) {
+	defer c.close()
+
+	var retryDelay time.Duration
+	for time.Now().Before(deadline) {
+		start := time.Now()
+		status, err := c.roundTrip(start)
+		if err != nil {
+			// the server reset or timed out the connection, the next request starts a new one
+			// after a delay doubling with every failure in a row
+			c.errors++
+			c.close()
+			retryDelay = min(max(retryDelay*2, minRetryDelay), maxRetryDelay)
+			time.Sleep(min(retryDelay, time.Until(deadline)))
+			continue
+		}
+		retryDelay = 0
+		c.latencies = append(c.latencies, time.Since(start))
+		c.statuses[status]++
+	}
+}
+
+// roundTrip sends one request and reads its response, dialing first when there is no connection
+func (c *conn) roundTrip(start time.Time) (int, error) {
+	if c.netConn == nil {
+		netConn, err := net.DialTimeout("tcp", c.opts.Addr, c.opts.Timeout)
+		if err != nil {
+			return 0, err
+		}
+		c.netConn, c.reader = netConn, bufio.NewReader(netConn)
+	}
+
+	c.netConn.SetDeadline(start.Add(c.opts.Timeout))
+	if _, err := c.netConn.Write(c.request); err != nil {
+		return 0, err
+	}
+
+	// the server answers with Content-Length and a Connection header, so http.ReadResponse
+	// knows where the response ends and whether the connection can be reused
+	resp, err := http.ReadResponse(c.reader, nil)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if resp.Close {
+		c.close()
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *conn) close() {
+	if c.netConn != nil {
+		c.netConn.Close()
+		c.netConn, c.reader = nil, nil
+	}
+}
@@ -2,6 +2,12 @@ package config
 
 import (
 	_ "embed"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
 )
 
 //go:embed config.yaml
@@ -12,14 +18,320 @@ type ServerConfig struct {
 	Name       string `koanf:"name"`
 	Port       int    `koanf:"port"`
 	Workers    int    `koanf:"workers"`
+	MinWorkers int    `koanf:"min_workers"` //workers kept running once idle ones exit
 	QueueSize  int    `koanf:"queue_size"`
 	TokenRate  int    `koanf:"token_rate"`
 	TokenLimit int    `koanf:"token_limit"`
+	Algorithm  string `koanf:"algorithm"` //global rate limiter, token_bucket, leaky_bucket or redis
+
+	StartEmpty bool `koanf:"start_empty"` //token buckets start without tokens and fill at their rate instead of allowing a burst at boot
+
+	WorkerIdleTimeout time.Duration `koanf:"worker_idle_timeout"` //idle workers exit after this, down to min_workers, 0 keeps them all
+	MaxWorkersPerCPU  int           `koanf:"max_workers_per_cpu"` //clamp workers to this many per cpu, 0 only warns about huge counts
+
+	ReadBufferSize  int `koanf:"read_buffer_size"`  //bytes read from the connection per call
+	MaxRequestBytes int `koanf:"max_request_bytes"` //request bodies bigger than this get 413
+	MaxHeaderBytes  int `koanf:"max_header_bytes"`  //request line and headers bigger than this get 431
+
+	Echo              bool `koanf:"echo"`                //respond with the request body instead of Hello world
+	ResponseSizeBytes int  `koanf:"response_size_bytes"` //respond with a body of this many bytes, 0 keeps Hello world
+
+	StaticDir string `koanf:"static_dir"` //serve the files under this directory, empty keeps Hello world
+
+	AllowedMethods []string `koanf:"allowed_methods"` //other methods get 405, empty allows any method
+
+	Compression         string `koanf:"compression"`           //gzip or none, gzip is only used for clients accepting it
+	CompressionMinBytes int    `koanf:"compression_min_bytes"` //smaller bodies are sent uncompressed
+
+	ForceStatus int     `koanf:"force_status"` //answer every request with this status, 0 disables it
+	ErrorRate   float64 `koanf:"error_rate"`   //fraction of requests answered with 500, 0 to 1
+
+	ResetRate            float64 `koanf:"reset_rate"`             //fraction of requests answered by resetting the connection, 0 to 1
+	ResetWithoutResponse bool    `koanf:"reset_without_response"` //reset before the response is sent instead of after it
+
+	ResponseDelay       time.Duration `koanf:"response_delay"`        //sleep before every response, cut short by timeouts.handler
+	ResponseDelayJitter time.Duration `koanf:"response_delay_jitter"` //random extra sleep between 0 and this
+
+	Network       string   `koanf:"network"`        //tcp, or tcp4/tcp6 to bind only IPv4/IPv6
+	ReusePort     bool     `koanf:"reuse_port"`     //SO_REUSEPORT, lets several processes bind the same port
+	ProxyProtocol bool     `koanf:"proxy_protocol"` //require a PROXY protocol v1/v2 header, for use behind a load balancer
+	Listen        []string `koanf:"listen"`         //more host:port addresses to accept on besides url:port
+
+	TCPNoDelay         bool          `koanf:"tcp_nodelay"`          //disable Nagle's algorithm on accepted connections
+	TCPKeepAlivePeriod time.Duration `koanf:"tcp_keepalive_period"` //TCP keep-alive probe interval, 0 uses the Go default and negative disables probes
+	ListenBacklog      int           `koanf:"listen_backlog"`       //pending connections the kernel queues before accept, 0 uses the system default
+
+	PerIPRate        int           `koanf:"per_ip_rate"`  //tokens per second for each client ip
+	PerIPLimit       int           `koanf:"per_ip_limit"` //bucket size for each client ip, 0 disables per ip limiting
+	PerIPIdleTimeout time.Duration `koanf:"per_ip_idle_timeout"`
+
+	QueueFullTimeout time.Duration `koanf:"queue_full_timeout"` //wait for a free queue slot before 503, 0 rejects immediately
+	OverflowPolicy   string        `koanf:"overflow_policy"`    //drop_new rejects new connections on a full queue, drop_old the oldest queued one
+	KeepAlive        bool          `koanf:"keep_alive"`         //serve more than one request per connection
+	DrainTimeout     time.Duration `koanf:"drain_timeout"`      //time given to in-flight connections on shutdown before they are force closed
+	PreShutdownDelay time.Duration `koanf:"preshutdown_delay"`  //keep serving with /readyz failing this long before shutting down
+	MaxConnections   int           `koanf:"max_connections"`    //open connections allowed at once, 0 means no limit
+	AcceptRate       int           `koanf:"accept_rate"`        //connections accepted per second, excess waits in the backlog, 0 means no limit
+
+	AcceptLoops int `koanf:"accept_loops"` //goroutines calling Accept on each listener, 0 means 1
+
+	MaxConnectionsPerIP int `koanf:"max_connections_per_ip"` //open connections allowed from one client ip, 0 means no limit, ignored with proxy_protocol
+
+	AllowCIDRs []string `koanf:"allow_cidrs"` //client ip ranges allowed to connect, empty allows every range not denied
+	DenyCIDRs  []string `koanf:"deny_cidrs"`  //client ip ranges disconnected right away, even when also allowed
+
+	ServerHeader string `koanf:"server_header"` //Server header on every response, empty leaves it out
+
+	RequestIDHeader string `koanf:"request_id_header"` //header with the request id, taken from the request or generated, empty disables ids
+
+	MinReadRate      int           `koanf:"min_read_rate"`       //bytes per second a request must arrive at, slower clients get 408; 0 disables it
+	MinReadRateGrace time.Duration `koanf:"min_read_rate_grace"` //time a request has before min_read_rate applies
+
+	AccessLog       string `koanf:"access_log"`        //off, stdout or a file path to append access log lines to
+	AccessLogFormat string `koanf:"access_log_format"` //common, combined or Apache style directives like %h %r %s %D
+
+	TLS      TLSConfig      `koanf:"tls"`
+	Auth     AuthConfig     `koanf:"auth"`
+	Overload OverloadConfig `koanf:"overload"`
+	Timeouts TimeoutsConfig `koanf:"timeouts"`
+	Redis    RedisConfig    `koanf:"redis"` //where the redis algorithm keeps its buckets
+
+	RateLimitedResponse RejectConfig `koanf:"rate_limited_response"` //sent when a rate limiter rejects a connection or request
+	RouteLimits         []RouteLimit `koanf:"route_limits"`          //own buckets for request paths, the first match wins
+	BusyResponse        RejectConfig `koanf:"busy_response"`         //sent when the worker pool queue is full
+}
+
+// Validate checks the server config for values which would start a broken server,
+// the error names the offending yaml field
+func (c ServerConfig) Validate() error {
+	if c.Workers < 1 {
+		return fmt.Errorf("server.workers must be at least 1, got %d", c.Workers)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("server.port must be between 0 and 65535, got %d", c.Port)
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("server.queue_size must not be negative, got %d", c.QueueSize)
+	}
+	if c.TokenRate < 0 {
+		return fmt.Errorf("server.token_rate must not be negative, got %d", c.TokenRate)
+	}
+	if c.TokenLimit < 0 {
+		return fmt.Errorf("server.token_limit must not be negative, got %d", c.TokenLimit)
+	}
+	if c.PerIPRate < 0 {
+		return fmt.Errorf("server.per_ip_rate must not be negative, got %d", c.PerIPRate)
+	}
+	if c.MinWorkers < 0 || c.MinWorkers > c.Workers {
+		return fmt.Errorf("server.min_workers must be between 0 and workers, got %d", c.MinWorkers)
+	}
+	if c.ResponseSizeBytes < 0 {
+		return fmt.Errorf("server.response_size_bytes must not be negative, got %d", c.ResponseSizeBytes)
+	}
+	if c.Echo && c.ResponseSizeBytes > 0 {
+		return errors.New("server.echo and server.response_size_bytes can't be used together")
+	}
+	if c.StaticDir != "" && (c.Echo || c.ResponseSizeBytes > 0) {
+		return errors.New("server.static_dir can't be used together with server.echo or server.response_size_bytes")
+	}
+	switch c.Compression {
+	case "", "none", "gzip":
+	default:
+		return fmt.Errorf("server.compression must be gzip or none, got %q", c.Compression)
+	}
+	if c.CompressionMinBytes < 0 {
+		return fmt.Errorf("server.compression_min_bytes must not be negative, got %d", c.CompressionMinBytes)
+	}
+	if c.ForceStatus != 0 && (c.ForceStatus < 100 || c.ForceStatus > 599) {
+		return fmt.Errorf("server.force_status must be between 100 and 599, got %d", c.ForceStatus)
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return fmt.Errorf("server.error_rate must be between 0 and 1, got %g", c.ErrorRate)
+	}
+	switch c.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("server.network must be tcp, tcp4 or tcp6, got %q", c.Network)
+	}
+	switch c.OverflowPolicy {
+	case "", "drop_new", "drop_old":
+	default:
+		return fmt.Errorf("server.overflow_policy must be drop_new or drop_old, got %q", c.OverflowPolicy)
+	}
+	if c.ResetRate < 0 || c.ResetRate > 1 {
+		return fmt.Errorf("server.reset_rate must be between 0 and 1, got %g", c.ResetRate)
+	}
+	if c.ForceStatus != 0 && c.ErrorRate > 0 {
+		return errors.New("server.force_status and server.error_rate can't be used together")
+	}
+	if c.ResponseDelay < 0 || c.ResponseDelayJitter < 0 {
+		return errors.New("server.response_delay and server.response_delay_jitter must not be negative")
+	}
+	if strings.ContainsAny(c.RequestIDHeader, " \t\r\n:") {
+		return fmt.Errorf("server.request_id_header must be a header name, got %q", c.RequestIDHeader)
+	}
+	for _, cidr := range slices.Concat(c.AllowCIDRs, c.DenyCIDRs) {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			return fmt.Errorf("server.allow_cidrs and server.deny_cidrs must be CIDRs like 10.0.0.0/8, got %q", cidr)
+		}
+	}
+	if c.MinReadRate < 0 || c.MinReadRateGrace < 0 {
+		return errors.New("server.min_read_rate and server.min_read_rate_grace must not be negative")
+	}
+	if c.PreShutdownDelay < 0 {
+		return fmt.Errorf("server.preshutdown_delay must not be negative, got %s", c.PreShutdownDelay)
+	}
+	if err := c.Timeouts.Validate(); err != nil {
+		return err
+	}
+	if c.Auth.Password != "" && c.Auth.Username == "" {
+		return errors.New("server.auth.password is set without server.auth.username")
+	}
+	if o := c.Overload; o.QueueThreshold < 0 || o.QueueThreshold > 1 {
+		return fmt.Errorf("server.overload.queue_threshold must be between 0 and 1, got %g", o.QueueThreshold)
+	}
+	if o := c.Overload; o.QueueThreshold > 0 && (o.Window < 0 || o.Cooldown <= 0) {
+		return errors.New("server.overload needs a positive cooldown and a window not below 0")
+	}
+	if c.MaxWorkersPerCPU < 0 {
+		return fmt.Errorf("server.max_workers_per_cpu must not be negative, got %d", c.MaxWorkersPerCPU)
+	}
+	if c.ListenBacklog < 0 {
+		return fmt.Errorf("server.listen_backlog must not be negative, got %d", c.ListenBacklog)
+	}
+	if c.AcceptLoops < 0 {
+		return fmt.Errorf("server.accept_loops must not be negative, got %d", c.AcceptLoops)
+	}
+	if c.AcceptRate < 0 {
+		return fmt.Errorf("server.accept_rate must not be negative, got %d", c.AcceptRate)
+	}
+	if c.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("server.max_connections_per_ip must not be negative, got %d", c.MaxConnectionsPerIP)
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("server.max_connections must not be negative, got %d", c.MaxConnections)
+	}
+	if c.PerIPLimit < 0 {
+		return fmt.Errorf("server.per_ip_limit must not be negative, got %d", c.PerIPLimit)
+	}
+	for _, route := range c.RouteLimits {
+		if route.Rate < 0 || route.Limit <= 0 {
+			return fmt.Errorf("server.route_limits %q needs a positive limit and a rate not below 0", route.Path)
+		}
+	}
+	switch c.Algorithm {
+	case "", "token_bucket", "leaky_bucket":
+	case "redis":
+		if c.Redis.Addr == "" {
+			return errors.New("server.redis.addr is required with the redis algorithm")
+		}
+		switch c.Redis.FailurePolicy {
+		case "open", "closed":
+		default:
+			return fmt.Errorf("server.redis.failure_policy must be open or closed, got %q", c.Redis.FailurePolicy)
+		}
+	default:
+		return fmt.Errorf("server.algorithm must be token_bucket, leaky_bucket or redis, got %q", c.Algorithm)
+	}
+	if c.StartEmpty && c.Algorithm == "leaky_bucket" {
+		return errors.New("server.start_empty only works with the token_bucket algorithm")
+	}
+	if c.ProxyProtocol && c.TLS.CertFile != "" && c.TLS.KeyFile != "" {
+		// the PROXY header comes before the TLS ClientHello, but TLS is terminated below it
+		return errors.New("server.proxy_protocol can't be used together with server.tls, terminate TLS at the load balancer")
+	}
+	if s := c.RateLimitedResponse.Status; s != 0 && (s < 400 || s > 599) {
+		return fmt.Errorf("server.rate_limited_response.status must be a 4xx or 5xx code, got %d", s)
+	}
+	if s := c.BusyResponse.Status; s != 0 && (s < 400 || s > 599) {
+		return fmt.Errorf("server.busy_response.status must be a 4xx or 5xx code, got %d", s)
+	}
+	return nil
+}
+
+// TLSConfig enables TLS on the server listener when both files are set
+type TLSConfig struct {
+	CertFile   string `koanf:"cert_file"`
+	KeyFile    string `koanf:"key_file"`
+	MinVersion string `koanf:"min_version"` //"1.0" to "1.3", defaults to 1.2
+}
+
+// AuthConfig requires an Authorization header when a bearer token or a username is set,
+// requests without valid credentials get 401
+type AuthConfig struct {
+	BearerToken string `koanf:"bearer_token"`
+	Username    string `koanf:"username"` //basic auth, checked together with password
+	Password    string `koanf:"password"`
+	Realm       string `koanf:"realm"`
+}
+
+// OverloadConfig rejects new connections with busy_response for cooldown once the queue was
+// filled above queue_threshold for window, then lets them in again to probe recovery
+type OverloadConfig struct {
+	QueueThreshold float64       `koanf:"queue_threshold"` //fraction of workers + queue_size, 0 disables it
+	Window         time.Duration `koanf:"window"`
+	Cooldown       time.Duration `koanf:"cooldown"`
+}
+
+// TimeoutsConfig are the deadlines of connections and requests, the fields match server.Timeouts
+type TimeoutsConfig struct {
+	ReadTimeout  time.Duration `koanf:"read"`  //reading a whole request, 0 uses the default 3s
+	WriteTimeout time.Duration `koanf:"write"` //writing a response, 0 uses the default 2s
+	IdleTimeout  time.Duration `koanf:"idle"`  //waiting for the next request on a kept alive connection, 0 uses the default 5s
+
+	HandlerTimeout        time.Duration `koanf:"handler"`        //budget for the whole request, 0 means no limit
+	MaxConnectionDuration time.Duration `koanf:"max_connection"` //close connections open this long even if active, 0 means no limit
+}
+
+// Validate rejects negative timeouts
+func (t TimeoutsConfig) Validate() error {
+	for _, timeout := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"read", t.ReadTimeout},
+		{"write", t.WriteTimeout},
+		{"idle", t.IdleTimeout},
+		{"handler", t.HandlerTimeout},
+		{"max_connection", t.MaxConnectionDuration},
+	} {
+		if timeout.value < 0 {
+			return fmt.Errorf("server.timeouts.%s must not be negative, got %s", timeout.key, timeout.value)
+		}
+	}
+	return nil
+}
+
+// RedisConfig points the redis rate limiting algorithm at the Redis server shared by all instances
+type RedisConfig struct {
+	Addr          string        `koanf:"addr"`
+	Password      string        `koanf:"password"` //better passed as TCPIE_SERVER_REDIS__PASSWORD
+	DB            int           `koanf:"db"`
+	KeyPrefix     string        `koanf:"key_prefix"`     //instances with the same prefix share their limits
+	FailurePolicy string        `koanf:"failure_policy"` //open lets requests through while Redis is unreachable, closed rejects them
+	Timeout       time.Duration `koanf:"timeout"`        //deadline of each check
+}
+
+// RouteLimit gives requests whose path matches Path a token bucket of their own,
+// paths without a match are only limited by the global limiter
+type RouteLimit struct {
+	Path  string `koanf:"path"` //exact path or a path.Match pattern like /api/*
+	Rate  int    `koanf:"rate"`
+	Limit int    `koanf:"limit"`
+}
+
+// RejectConfig overrides the response sent to rejected clients, zero values keep the defaults
+type RejectConfig struct {
+	Status     int           `koanf:"status"`
+	Body       string        `koanf:"body"`
+	RetryAfter time.Duration `koanf:"retry_after"` //Retry-After header, 0 derives it from the refill rate for rate limits and leaves it out otherwise
 }
 
 type PromethuesConfig struct {
-	MetricsPort int64 `koanf:"metrics_port"`
-	Global      struct {
+	MetricsPort    int64     `koanf:"metrics_port"`
+	LatencyBuckets []float64 `koanf:"latency_buckets"` //request duration buckets in seconds, empty uses prometheus defaults
+	KnownPaths     []string  `koanf:"known_paths"`     //paths labeled as is on http_requests_total, the rest count as other
+	Global         struct {
 		ScrapeInterval   string `koanf:"scrape_interval"`
 		EvaluateInterval string `koanf:"evaluate_interval"`
 	} `koanf:"global"`
@@ -31,9 +343,41 @@ type PromethuesConfig struct {
 			Targets []string `koanf:"targets"`
 		} `koanf:"static_configs"`
 	} `koanf:"scrape_configs"`
+
+	OnMainPort  bool `koanf:"metrics_on_main_port"` //serve metrics and probes on the server port, metrics_port is not used
+	EnablePprof bool `koanf:"enable_pprof"`         //serve net/http/pprof under /debug/pprof/ and POST /drain, which fails /readyz and stops accepting
+}
+
+// Validate checks the prometheus config, auth is the one of the server port
+func (c PromethuesConfig) Validate(auth AuthConfig) error {
+	// on the main port the debug endpoints are only guarded by server.auth, without it
+	// any client could profile the server or drain it
+	if c.OnMainPort && c.EnablePprof && auth.BearerToken == "" && auth.Username == "" {
+		return errors.New("prometheus.enable_pprof with prometheus.metrics_on_main_port requires server.auth")
+	}
+	return nil
+}
+
+// LogConfig selects the log output format and the minimum level
+type LogConfig struct {
+	Format string `koanf:"format"` //text or json
+	Level  string `koanf:"level"`  //debug, info, warn or error
+
+	SampleRate int `koanf:"sample_rate"` //log the per request debug lines for 1 in N connections
+}
+
+// TracingConfig enables OpenTelemetry spans for every request, exported over OTLP/HTTP
+type TracingConfig struct {
+	Enabled     bool    `koanf:"enabled"`
+	Endpoint    string  `koanf:"endpoint"`     //host:port of the OTLP/HTTP collector
+	Insecure    bool    `koanf:"insecure"`     //plain HTTP to the collector
+	ServiceName string  `koanf:"service_name"` //service.name reported on the spans
+	SampleRatio float64 `koanf:"sample_ratio"` //fraction of new traces sampled, 0 to 1
 }
 
 type Configs struct {
 	Server     ServerConfig     `koanf:"server"`
 	Promethues PromethuesConfig `koanf:"promethues"`
+	Log        LogConfig        `koanf:"log"`
+	Tracing    TracingConfig    `koanf:"tracing"`
 } //exports all above structs config cleanly to use
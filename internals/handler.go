@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Handler builds the response for a parsed request, the worker takes care of
+// Content-Length and Connection headers. A header value with several lines is sent
+// as one header per line, e.g. for more than one Set-Cookie
+type Handler func(req *http.Request) (status int, headers map[string]string, body []byte)
+
+// Middleware wraps a handler to act before or after it, e.g. to reject requests early
+type Middleware func(next Handler) Handler
+
+// chain wraps h in middleware, the first one is the outermost and sees a request first
+func chain(h Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// helloHandler is used when no handler is configured
+func helloHandler(req *http.Request) (int, map[string]string, []byte) {
+	return http.StatusOK, nil, []byte("Hello world !\n")
+}
+
+// allowMethods answers requests with a method outside allowed with 405 and an Allow header
+// listing the allowed ones. With allowed empty every method is passed on
+func allowMethods(allowed []string) Middleware {
+	if len(allowed) == 0 {
+		return passThrough
+	}
+
+	methods := make(map[string]struct{}, len(allowed))
+	for _, method := range allowed {
+		methods[method] = struct{}{}
+	}
+	allowHeader := strings.Join(allowed, ", ")
+
+	return func(next Handler) Handler {
+		return func(req *http.Request) (int, map[string]string, []byte) {
+			if _, ok := methods[req.Method]; !ok {
+				return http.StatusMethodNotAllowed, map[string]string{"Allow": allowHeader}, []byte("Method Not Allowed\n")
+			}
+			return next(req)
+		}
+	}
+}
+
+// injectFaults answers every request with forceStatus when it is set, and otherwise a random
+// errorRate fraction of them with 500, without calling the handler. For testing how clients
+// cope with failing servers, with both zero every request is passed on
+func injectFaults(forceStatus int, errorRate float64) Middleware {
+	if forceStatus == 0 && errorRate <= 0 {
+		return passThrough
+	}
+
+	return func(next Handler) Handler {
+		return func(req *http.Request) (int, map[string]string, []byte) {
+			status := forceStatus
+			if status == 0 && rand.Float64() < errorRate {
+				status = http.StatusInternalServerError
+			}
+			if status == 0 {
+				return next(req)
+			}
+			return status, nil, []byte(http.StatusText(status) + "\n")
+		}
+	}
+}
+
+// compressGzip gzips response bodies of at least minSize bytes for clients accepting gzip,
+// Content-Length is computed from the compressed body by the worker
+func compressGzip(minSize int) Middleware {
+	return func(next Handler) Handler {
+		return func(req *http.Request) (int, map[string]string, []byte) {
+			status, headers, body := next(req)
+			if len(body) < minSize || !acceptsGzip(req) || hasHeader(headers, "Content-Encoding") {
+				return status, headers, body
+			}
+
+			var b bytes.Buffer
+			zw := gzip.NewWriter(&b)
+			zw.Write(body)
+			zw.Close()
+
+			compressed := make(map[string]string, len(headers)+2)
+			for name, value := range headers {
+				compressed[name] = value
+			}
+			compressed["Content-Encoding"] = "gzip"
+			compressed["Vary"] = "Accept-Encoding"
+			return status, compressed, b.Bytes()
+		}
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of req lists gzip without q=0
+func acceptsGzip(req *http.Request) bool {
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if strings.TrimSpace(name) != "gzip" {
+				continue
+			}
+			q := strings.ReplaceAll(params, " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
+
+// hasHeader reports whether headers has name, whatever its case
+func hasHeader(headers map[string]string, name string) bool {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// passThrough is the middleware that does nothing
+func passThrough(next Handler) Handler {
+	return next
+}
+
+// routeToHTTP serves requests for one of paths with h, a standard library handler whose
+// response is recorded and written by the worker like any other. Paths ending in / match
+// everything below them. With h nil every request is passed on
+func routeToHTTP(h http.Handler, paths []string) Middleware {
+	if h == nil {
+		return passThrough
+	}
+
+	routes := make(map[string]struct{}, len(paths))
+	var prefixes []string
+	for _, path := range paths {
+		if strings.HasSuffix(path, "/") {
+			prefixes = append(prefixes, path)
+			continue
+		}
+		routes[path] = struct{}{}
+	}
+
+	return func(next Handler) Handler {
+		return func(req *http.Request) (int, map[string]string, []byte) {
+			_, ok := routes[req.URL.Path]
+			if !ok && !slices.ContainsFunc(prefixes, func(prefix string) bool { return strings.HasPrefix(req.URL.Path, prefix) }) {
+				return next(req)
+			}
+
+			rec := &responseRecorder{header: make(http.Header)}
+			h.ServeHTTP(rec, req)
+			return rec.result()
+		}
+	}
+}
+
+// responseRecorder is the http.ResponseWriter routeToHTTP passes to standard library handlers,
+// it keeps the response so the worker can write it
+type responseRecorder struct {
+	header http.Header
+	status int //0 until WriteHeader or Write
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// result converts the recorded response to what a Handler returns, every value of a header
+// is kept on a line of its own. Like net/http a missing Content-Type is sniffed from the body
+func (r *responseRecorder) result() (int, map[string]string, []byte) {
+	r.WriteHeader(http.StatusOK)
+	body := r.body.Bytes()
+	if _, ok := r.header["Content-Type"]; !ok && len(body) > 0 {
+		r.header.Set("Content-Type", http.DetectContentType(body))
+	}
+
+	headers := make(map[string]string, len(r.header))
+	for name, values := range r.header {
+		headers[name] = strings.Join(values, "\n")
+	}
+	return r.status, headers, body
+}
+
+// EchoHandler responds with the request body, under the request Content-Type when it has one
+func EchoHandler(req *http.Request) (int, map[string]string, []byte) {
+	// the worker reads the body upfront, this only copies it out of memory
+	body, _ := io.ReadAll(req.Body)
+
+	var headers map[string]string
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		headers = map[string]string{"Content-Type": contentType}
+	}
+	return http.StatusOK, headers, body
+}
+
+// FixedSizeHandler returns a handler responding with a body of exactly size bytes,
+// the body is built once and shared by all requests
+func FixedSizeHandler(size int) Handler {
+	body := bytes.Repeat([]byte("x"), size)
+	return func(req *http.Request) (int, map[string]string, []byte) {
+		return http.StatusOK, nil, body
+	}
+}
+
+// buildResponse serializes a handler result into a HTTP/1.1 response, Content-Length is
+// always computed from body. With head, for a HEAD request, body is left out but still counted
+// in Content-Length. 1xx, 204 and 304 responses get neither, they can't have a body
+func buildResponse(status int, headers map[string]string, body []byte, keepAlive, head bool) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+
+	// sorted so responses are byte for byte reproducible
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		switch strings.ToLower(name) {
+		case "content-length", "connection":
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for value := range strings.SplitSeq(headers[name], "\n") {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, strings.TrimSuffix(value, "\r"))
+		}
+	}
+
+	connection := "close"
+	if keepAlive {
+		connection = "keep-alive"
+	}
+	if !statusHasBody(status) {
+		fmt.Fprintf(&b, "Connection: %s\r\n\r\n", connection)
+		return b.Bytes()
+	}
+	fmt.Fprintf(&b, "Connection: %s\r\nContent-Length: %d\r\n\r\n", connection, len(body))
+	if !head {
+		b.Write(body)
+	}
+	return b.Bytes()
+}
+
+// statusHasBody reports whether a response with status may have a body. A client reads none for
+// the others, bytes sent anyway would be taken for the next response on a kept alive connection
+func statusHasBody(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPFilter decides which client ips may connect. A denied ip is rejected even when an allowed
+// range contains it too, with no allowed ranges every ip that isn't denied may connect
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter parses the allowed and denied ranges, in CIDR notation like 10.0.0.0/8 or
+// fd00::/8. It returns nil, which lets everyone in, when both lists are empty
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	f := &IPFilter{}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Enabled reports whether f restricts anything, it is false for a nil filter
+func (f *IPFilter) Enabled() bool {
+	return f != nil
+}
+
+// Allowed reports whether ip may connect, an address that doesn't parse as an ip never may
+func (f *IPFilter) Allowed(ip string) bool {
+	// link local ipv6 addresses carry the zone, e.g. fe80::1%eth0
+	ip, _, _ = strings.Cut(ip, "%")
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	if containsIP(f.deny, parsed) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, parsed)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
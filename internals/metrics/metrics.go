@@ -1,9 +1,15 @@
 package metrics
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,7 +18,34 @@ import (
 
 // ServerMetrics struct for server metrics using prometheus
 type ServerMetrics struct {
-	Requests *prometheus.CounterVec
+	Requests     *prometheus.CounterVec   //accepted connections, labeled by outcome
+	Rejections   *prometheus.CounterVec   //connections rejected before being served, labeled by reason
+	HTTPRequests *prometheus.CounterVec   //parsed requests, labeled by method and normalized path
+	Completed    *prometheus.CounterVec   //responses written by workers, labeled by status code
+	Latency      *prometheus.HistogramVec //time taken to serve a request, labeled by outcome
+
+	ConnectionDuration prometheus.Histogram //time from accept to close, spans every request of a kept alive connection
+	QueueWait          prometheus.Histogram //time jobs wait in the queue until a worker picks them up
+	LimiterCheck       prometheus.Histogram //time the accept loop spends asking the global rate limiter, lock waits included
+
+	ActiveConnections prometheus.Gauge   //connections accepted into the pool and not closed yet
+	Panics            prometheus.Counter //panics recovered by workers
+	QueueDepth        prometheus.Gauge   //jobs waiting in the worker pool channel
+	InFlight          prometheus.Gauge   //jobs being served by a worker
+	JobsCompleted     prometheus.Counter //jobs workers finished serving, whatever the outcome
+	PoolSaturated     prometheus.Counter //times a job found the worker pool queue full
+	BreakerState      prometheus.Gauge   //overload breaker state: 0 closed, 1 half open, 2 open
+
+	LimiterTokens      prometheus.Gauge //tokens left in the global rate limiter
+	IPBuckets          prometheus.Gauge //client ips the per ip limiter tracks
+	IPBucketsExhausted prometheus.Gauge //tracked client ips without a token left
+
+	BytesRead    prometheus.Counter //bytes read from client connections by workers
+	BytesWritten prometheus.Counter //bytes written to client connections by workers
+
+	SlowClients prometheus.Counter //connections closed for sending a request slower than min_read_rate
+
+	BuildInfo *prometheus.GaugeVec //always 1, the labels identify the running build
 }
 
 // used to export metrics captures to prometheus
@@ -20,39 +53,346 @@ type MetricsExport struct {
 	Metrics  ServerMetrics //metrics that server supports
 	Port     int64         //port in which exporter will run
 	Endpoint string        //endpoint which promethues will call to get scrap metrics
+	Ready    func() bool   //reports readiness for /readyz, nil means never ready
+	Pprof    bool          //serve the debug endpoints: net/http/pprof under /debug/pprof/ and POST /drain, which takes the server out of rotation
+	Drain    func()        //called by POST /drain, which answers 404 while it is nil
+
+	// keep retrying a busy port this long, a restarted server waits for the old process to let go of it
+	BindTimeout time.Duration
+
+	server *http.Server //created with the exporter so Shutdown works before ExportMetrics runs
 }
 
-func (s *ServerMetrics) CreateMetrics() {
+// CreateMetrics builds the metrics, latencyBuckets falls back to prometheus.DefBuckets when empty
+func (s *ServerMetrics) CreateMetrics(latencyBuckets []float64) {
 	s.Requests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "total_requests",
-			Help: "Number of requests proccessed by a server",
+			Help: "Number of connections accepted by the server, labeled by outcome: processed or the rejected_ reason",
+		},
+		[]string{"outcome"},
+	)
+
+	s.Rejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rejections_total",
+			Help: "Number of connections rejected before a worker served them, labeled by reason: rate_limited, per_ip_limit, max_connections, max_connections_per_ip, overload, queue_full, evicted (queued and counted as processed first), shutting_down, bad_proxy_header or ip_denied",
+		},
+		[]string{"reason"},
+	)
+
+	s.HTTPRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of parsed HTTP requests, paths outside the known set are counted as other",
+		},
+		[]string{"method", "path"},
+	)
+
+	s.Completed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "requests_completed_total",
+			Help: "Number of responses written by workers, total_requests counts them when they are accepted",
+		},
+		[]string{"status"},
+	)
+
+	if len(latencyBuckets) == 0 {
+		latencyBuckets = prometheus.DefBuckets
+	}
+	s.Latency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "request_duration_seconds",
+			Help:    "Time taken by a worker to serve a request",
+			Buckets: latencyBuckets,
+		},
+		[]string{"outcome"},
+	)
+
+	// kept alive connections live far longer than a request, so the buckets go up to minutes
+	s.ConnectionDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "connection_duration_seconds",
+			Help:    "Time from accepting a connection to closing it, including the time it waited in the queue",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
 		},
-		[]string{"Processed"},
+	)
+
+	// waits are short unless the pool is saturated, so the buckets start well below a millisecond
+	s.QueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "queue_wait_seconds",
+			Help:    "Time jobs wait in the worker pool queue before a worker picks them up, request_duration_seconds is the time after",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+	)
+
+	s.LimiterCheck = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "rate_limiter_check_seconds",
+			Help:    "Time the accept loop spends in the global rate limiter check, including waiting for its lock, or the Redis round trip with algorithm redis",
+			Buckets: prometheus.ExponentialBuckets(0.0000001, 5, 10),
+		},
+	)
+
+	s.ActiveConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "active_connections",
+			Help: "Number of connections queued or being served by workers",
+		},
+	)
+
+	s.Panics = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "worker_panics_total",
+			Help: "Number of panics recovered while processing requests",
+		},
+	)
+
+	s.QueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "queue_depth",
+			Help: "Number of jobs waiting in the worker pool queue, it rejects once this reaches workers + queue_size",
+		},
+	)
+
+	s.InFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "jobs_in_flight",
+			Help: "Number of jobs taken off the queue and being served by workers, queue_depth counts the waiting ones",
+		},
+	)
+
+	s.JobsCompleted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "jobs_completed_total",
+			Help: "Number of jobs workers finished serving, a kept alive connection is one job",
+		},
+	)
+
+	s.PoolSaturated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pool_saturated_total",
+			Help: "Number of times a connection found every worker busy and the queue full, a signal to scale out",
+		},
+	)
+
+	s.BreakerState = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "State of the overload breaker: 0 closed, 1 half open, 2 open and rejecting new connections",
+		},
+	)
+
+	s.LimiterTokens = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rate_limiter_tokens",
+			Help: "Number of requests the global rate limiter would let through right now, sampled every second",
+		},
+	)
+
+	s.IPBuckets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rate_limiter_ip_buckets",
+			Help: "Number of client ips tracked by the per ip rate limiter, sampled every second",
+		},
+	)
+
+	s.IPBucketsExhausted = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rate_limiter_ip_buckets_exhausted",
+			Help: "Number of tracked client ips without a token left, sampled every second",
+		},
+	)
+
+	s.BytesRead = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "bytes_read_total",
+			Help: "Number of bytes read from client connections, including PROXY headers and request bodies",
+		},
+	)
+
+	s.BytesWritten = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "bytes_written_total",
+			Help: "Number of bytes written to client connections",
+		},
+	)
+
+	s.SlowClients = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "slow_clients_evicted_total",
+			Help: "Number of connections answered with 408 and closed because their request arrived slower than min_read_rate",
+		},
+	)
+
+	s.BuildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "build_info",
+			Help: "Always 1, labeled with the version, git commit, build date and Go version of the running binary",
+		},
+		[]string{"version", "commit", "build_date", "goversion"},
 	)
 }
 
-func (e *MetricsExport) ExportMetrics() {
+// prefix of the pprof routes
+const pprofPrefix = "/debug/pprof/"
+
+// route of the drain endpoint
+const drainPath = "/drain"
+
+// Handler returns the routes of the exporter: the metrics endpoint, /healthz, /readyz and the debug endpoints when enabled
+func (e *MetricsExport) Handler() http.Handler {
 	r := mux.NewRouter()
 
 	r.Path(e.Endpoint).Handler(promhttp.Handler())
+	r.Path("/healthz").HandlerFunc(healthz)
+	r.Path("/readyz").HandlerFunc(e.readyz)
+	if e.Pprof {
+		r.Path(pprofPrefix + "cmdline").HandlerFunc(pprof.Cmdline)
+		r.Path(pprofPrefix + "profile").HandlerFunc(pprof.Profile)
+		r.Path(pprofPrefix + "symbol").HandlerFunc(pprof.Symbol)
+		r.Path(pprofPrefix + "trace").HandlerFunc(pprof.Trace)
+		// Index also serves the named profiles like heap and goroutine
+		r.PathPrefix(pprofPrefix).HandlerFunc(pprof.Index)
+		r.Path(drainPath).Methods(http.MethodPost).HandlerFunc(e.drain)
+	}
+	return r
+}
+
+// Paths returns the metrics and probe paths Handler serves, DebugPaths returns the others
+func (e *MetricsExport) Paths() []string {
+	return []string{e.Endpoint, "/healthz", "/readyz"}
+}
+
+// DebugPaths returns the paths of the debug endpoints Handler serves, none unless Pprof is set.
+// The ones ending in / are prefixes
+func (e *MetricsExport) DebugPaths() []string {
+	if !e.Pprof {
+		return nil
+	}
+	return []string{pprofPrefix, drainPath}
+}
+
+// ExportMetrics serves Handler on Port until Shutdown, which makes it return nil, or until the
+// listener fails. Metrics aren't critical, callers usually log the error and keep serving traffic
+func (e *MetricsExport) ExportMetrics() error {
+	if e.server == nil {
+		// built as a literal instead of with NewExportMetrics
+		e.server = &http.Server{}
+	}
+	e.server.Handler = e.Handler()
 	log.Printf("Starting metrics exporter on port: %d", e.Port)
 
-	err := http.ListenAndServe(":"+fmt.Sprintf("%d", e.Port), r)
-	log.Fatal(err)
+	listener, err := listenRetry(":"+fmt.Sprintf("%d", e.Port), e.BindTimeout)
+	if err != nil {
+		return fmt.Errorf("metrics exporter: %w", err)
+	}
+
+	// after Shutdown Serve returns right away and closes the listener
+	err = e.server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return fmt.Errorf("metrics exporter: %w", err)
+}
+
+// Shutdown stops the exporter, waiting for in-flight scrapes until ctx expires
+func (e *MetricsExport) Shutdown(ctx context.Context) error {
+	if e.server == nil {
+		return nil
+	}
+	return e.server.Shutdown(ctx)
+}
+
+// listenRetry listens on addr, retrying for up to timeout while the address is in use
+func listenRetry(addr string, timeout time.Duration) (net.Listener, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		listener, err := net.Listen("tcp", addr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || time.Now().After(deadline) {
+			return listener, err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// healthz is the liveness probe, it answers as long as the process is running
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// drain puts the server into drain mode, /readyz fails from here on
+func (e *MetricsExport) drain(w http.ResponseWriter, r *http.Request) {
+	if e.Drain == nil {
+		http.NotFound(w, r)
+		return
+	}
+	e.Drain()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("draining\n"))
+}
+
+// readyz is the readiness probe, it fails until the server accepts connections and again once it starts shutting down
+func (e *MetricsExport) readyz(w http.ResponseWriter, r *http.Request) {
+	if e.Ready == nil || !e.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ready\n"))
+}
+
+// register adds c to the default registry. When a collector of the same name is registered
+// already, by an earlier NewServerMetrics, that one is returned, so every server in the
+// process records into the series the exporter serves instead of into unregistered ones
+func register[T prometheus.Collector](c T) T {
+	err := prometheus.Register(c)
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		if existing, ok := registered.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	return c
 }
 
-func NewServerMetrics() ServerMetrics {
+// NewServerMetrics creates the server metrics in the default registry. Sets created after the
+// first share its collectors, latencyBuckets included, so servers built in one process add up
+func NewServerMetrics(latencyBuckets []float64) ServerMetrics {
 	reqMetrics := ServerMetrics{}
-	reqMetrics.CreateMetrics()
-	prometheus.Register(reqMetrics.Requests)
+	reqMetrics.CreateMetrics(latencyBuckets)
+	reqMetrics.Requests = register(reqMetrics.Requests)
+	reqMetrics.Rejections = register(reqMetrics.Rejections)
+	reqMetrics.HTTPRequests = register(reqMetrics.HTTPRequests)
+	reqMetrics.Completed = register(reqMetrics.Completed)
+	reqMetrics.Latency = register(reqMetrics.Latency)
+	reqMetrics.ConnectionDuration = register(reqMetrics.ConnectionDuration)
+	reqMetrics.QueueWait = register(reqMetrics.QueueWait)
+	reqMetrics.LimiterCheck = register(reqMetrics.LimiterCheck)
+	reqMetrics.ActiveConnections = register(reqMetrics.ActiveConnections)
+	reqMetrics.Panics = register(reqMetrics.Panics)
+	reqMetrics.QueueDepth = register(reqMetrics.QueueDepth)
+	reqMetrics.InFlight = register(reqMetrics.InFlight)
+	reqMetrics.JobsCompleted = register(reqMetrics.JobsCompleted)
+	reqMetrics.PoolSaturated = register(reqMetrics.PoolSaturated)
+	reqMetrics.BreakerState = register(reqMetrics.BreakerState)
+	reqMetrics.LimiterTokens = register(reqMetrics.LimiterTokens)
+	reqMetrics.IPBuckets = register(reqMetrics.IPBuckets)
+	reqMetrics.IPBucketsExhausted = register(reqMetrics.IPBucketsExhausted)
+	reqMetrics.BytesRead = register(reqMetrics.BytesRead)
+	reqMetrics.BytesWritten = register(reqMetrics.BytesWritten)
+	reqMetrics.SlowClients = register(reqMetrics.SlowClients)
+	reqMetrics.BuildInfo = register(reqMetrics.BuildInfo)
 
 	return reqMetrics
 }
 
-func NewExportMetrics(port int64, endpoint string) MetricsExport {
-	metrics := NewServerMetrics()
-	exporter := MetricsExport{Port: port}
+func NewExportMetrics(port int64, endpoint string, latencyBuckets []float64) MetricsExport {
+	metrics := NewServerMetrics(latencyBuckets)
+	exporter := MetricsExport{Port: port, server: &http.Server{}}
 	exporter.Metrics = metrics
 	exporter.Endpoint = endpoint
 
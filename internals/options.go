@@ -0,0 +1,114 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/atharvamhaske/tcpie/internals/metrics"
+)
+
+// workers New starts when Config doesn't set MaxThreads
+const defaultWorkers = 2
+
+// Config is everything New needs to build a server, it is filled in Go code so tcpie can run
+// inside another binary without any config file
+type Config struct {
+	URL  string //host to listen on, empty listens on every interface
+	Port int    //0 lets the kernel pick a free port
+	ServerOpts
+
+	// nil uses the set registered with the default prometheus registry, created by the first
+	// server, so every server of the process is exported. Pass one to record elsewhere
+	Metrics *metrics.ServerMetrics
+}
+
+// Option changes the Config New builds the server from
+type Option func(*Config)
+
+// WithMetrics makes the server record into m instead of a set of its own
+func WithMetrics(m metrics.ServerMetrics) Option {
+	return func(cfg *Config) {
+		cfg.Metrics = &m
+	}
+}
+
+// WithLogger sets the logger of the server and its workers
+func WithLogger(logger *slog.Logger) Option {
+	return func(cfg *Config) {
+		cfg.Logger = logger
+	}
+}
+
+// New creates a server from cfg after applying opts in order. Unset options get the same
+// defaults as NewServer, a zero MaxThreads starts defaultWorkers workers
+func New(cfg Config, opts ...Option) (*Server, error) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.MaxThreads <= 0 {
+		cfg.MaxThreads = defaultWorkers
+	}
+	if cfg.Metrics == nil {
+		m := metrics.NewServerMetrics(nil)
+		cfg.Metrics = &m
+	}
+	return newServer(cfg.URL, cfg.Port, cfg.ServerOpts, *cfg.Metrics)
+}
+
+// ServerOption is an Option, the name reads better next to NewWithOptions
+type ServerOption = Option
+
+// NewWithOptions creates a server from options alone, everything not set by one of them has
+// its default. Without WithAddr it listens on a port picked by the kernel
+func NewWithOptions(opts ...ServerOption) (*Server, error) {
+	return New(Config{}, opts...)
+}
+
+// WithAddr sets the host and port the server listens on
+func WithAddr(url string, port int) Option {
+	return func(cfg *Config) {
+		cfg.URL, cfg.Port = url, port
+	}
+}
+
+// WithTLS serves TLS with the given certificate and key files
+func WithTLS(certFile, keyFile string) Option {
+	return func(cfg *Config) {
+		cfg.TLSCertFile, cfg.TLSKeyFile = certFile, keyFile
+	}
+}
+
+// WithLimiter enables the global rate limit: rate tokens per second with bursts of up to tokens
+func WithLimiter(rate, tokens int64) Option {
+	return func(cfg *Config) {
+		cfg.Rate, cfg.Tokens = rate, tokens
+	}
+}
+
+// WithHandler sets the handler building the response of every request
+func WithHandler(h Handler) Option {
+	return func(cfg *Config) {
+		cfg.Handler = h
+	}
+}
+
+// WithMiddleware adds middleware around the handler, after any added before
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(cfg *Config) {
+		cfg.Middleware = append(cfg.Middleware, middleware...)
+	}
+}
+
+// WithTimeouts sets every timeout of the server, start from DefaultTimeouts to change only some
+func WithTimeouts(t Timeouts) Option {
+	return func(cfg *Config) {
+		cfg.Timeouts = t
+	}
+}
+
+// WithWorkers sets the number of workers and how many jobs may wait for one
+func WithWorkers(workers, queueSize int) Option {
+	return func(cfg *Config) {
+		cfg.MaxThreads, cfg.QueueSize = workers, queueSize
+	}
+}
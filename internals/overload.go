@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// OverloadOptions sheds load once the worker pool queue stays too full. Connections are
+// rejected with BusyResponse for Cooldown, then the breaker half-opens and lets them in
+// again, closing once the queue stayed below the threshold for Window
+type OverloadOptions struct {
+	QueueThreshold float64       //fraction of the queue capacity, from 0 to 1, 0 disables the breaker
+	Window         time.Duration //how long the queue must stay above the threshold to trip
+	Cooldown       time.Duration //how long new connections are rejected once tripped
+}
+
+// states of the overload breaker, the values are what the circuit_breaker_state gauge reports
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+// overloadBreaker is a circuit breaker driven by the queue fill level
+type overloadBreaker struct {
+	opts OverloadOptions
+
+	mutex sync.Mutex
+	state int
+	since time.Time //when state was entered, or when the queue went above the threshold while closed
+	above bool      //the queue was above the threshold at the last check while closed
+}
+
+// newOverloadBreaker returns nil when opts disable the breaker, a nil breaker allows everything
+func newOverloadBreaker(opts OverloadOptions) *overloadBreaker {
+	if opts.QueueThreshold <= 0 {
+		return nil
+	}
+	return &overloadBreaker{opts: opts}
+}
+
+// allow records the queue fill level, from 0 to 1, and reports whether a new connection may
+// be queued. It also returns the state after the check and, when open, how long it stays open
+func (b *overloadBreaker) allow(fill float64) (bool, int, time.Duration) {
+	if b == nil {
+		return true, breakerClosed, 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	overloaded := fill >= b.opts.QueueThreshold
+	switch b.state {
+	case breakerClosed:
+		if !overloaded {
+			b.above = false
+			return true, b.state, 0
+		}
+		if !b.above {
+			b.above, b.since = true, now
+		}
+		if now.Sub(b.since) >= b.opts.Window {
+			b.open(now)
+			return false, b.state, b.opts.Cooldown
+		}
+		return true, b.state, 0
+
+	case breakerOpen:
+		if left := b.opts.Cooldown - now.Sub(b.since); left > 0 {
+			return false, b.state, left
+		}
+		b.state, b.since = breakerHalfOpen, now
+		fallthrough
+
+	default: // half open, probing whether the workers caught up
+		if overloaded {
+			b.open(now)
+			return false, b.state, b.opts.Cooldown
+		}
+		if now.Sub(b.since) >= b.opts.Window {
+			b.state, b.above = breakerClosed, false
+		}
+		return true, b.state, 0
+	}
+}
+
+func (b *overloadBreaker) open(now time.Time) {
+	b.state, b.since, b.above = breakerOpen, now, false
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// every PROXY protocol v2 header starts with this signature
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errBadProxyHeader = errors.New("invalid PROXY protocol header")
+
+// a v1 header is a single line of at most 107 bytes including CRLF
+const maxProxyV1Length = 107
+
+// proxyConn is a connection whose client address came from a PROXY protocol header,
+// reads go through the reader that parsed the header so no request bytes are lost
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyHeader parses the PROXY protocol v1 or v2 header at the start of conn and returns
+// a connection reporting the real client address. Headers that carry no address (UNKNOWN,
+// LOCAL) keep the socket address, anything that isn't a PROXY header is an error
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	sig, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		remote, err = parseProxyV2(reader)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		remote, err = parseProxyV1(reader)
+	default:
+		return nil, errBadProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, reader: reader, remoteAddr: remote}, nil
+}
+
+// parseProxyV1 parses the text form, e.g. "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func parseProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, errBadProxyHeader
+	}
+	if len(line) > maxProxyV1Length || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parseProxyV2 parses the binary form: signature, version/command, family/protocol,
+// address block length and then the addresses
+func parseProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errBadProxyHeader
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, addrs); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0:
+		// LOCAL, the balancer talking for itself (health checks)
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, errBadProxyHeader
+	}
+
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET: src addr, dst addr, src port, dst port
+		if len(addrs) < 12 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(addrs) < 36 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	default:
+		// unix sockets or unspecified, keep the socket address
+		return nil, nil
+	}
+}
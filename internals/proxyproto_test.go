@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header with the given command (0 LOCAL, 1 PROXY), family byte and address block
+func proxyV2(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// ipv4Addrs is the v2 address block of 192.168.0.1:56324 -> 10.0.0.1:443
+var ipv4Addrs = []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv6Addrs := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	ipv6Addrs = append(ipv6Addrs, 0xdc, 0x04, 0x01, 0xbb)
+
+	tests := []struct {
+		name     string
+		header   string
+		wantAddr string //empty expects the socket address
+		wantErr  bool
+	}{
+		{name: "v1 tcp4", header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", wantAddr: "192.168.0.1:56324"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", wantAddr: "[2001:db8::1]:56324"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 missing fields", header: "PROXY TCP4 192.168.0.1 56324\r\n", wantErr: true},
+		{name: "v1 bad ip", header: "PROXY TCP4 192.168.0 192.168.0.11 56324 443\r\n", wantErr: true},
+		{name: "v1 bad port", header: "PROXY TCP4 192.168.0.1 192.168.0.11 70000 443\r\n", wantErr: true},
+		{name: "v1 without CR", header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", wantErr: true},
+		{name: "v2 ipv4", header: string(proxyV2(0x1, 0x11, ipv4Addrs)), wantAddr: "192.168.0.1:56324"},
+		{name: "v2 ipv6", header: string(proxyV2(0x1, 0x21, ipv6Addrs)), wantAddr: "[2001:db8::1]:56324"},
+		{name: "v2 local", header: string(proxyV2(0x0, 0x00, nil))},
+		{name: "v2 unspecified family", header: string(proxyV2(0x1, 0x00, nil))},
+		{name: "v2 short ipv4 block", header: string(proxyV2(0x1, 0x11, ipv4Addrs[:8])), wantErr: true},
+		{name: "v2 bad command", header: string(proxyV2(0x5, 0x11, ipv4Addrs)), wantErr: true},
+		{name: "no header", header: "GET / HTTP/1.1\r\nHost: test\r\n\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := connPair(t)
+			server.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// the request after the header must reach the caller untouched
+			const request = "GET / HTTP/1.1\r\nHost: test\r\n\r\n"
+			io.WriteString(client, tt.header+request)
+			client.(*net.TCPConn).CloseWrite()
+
+			conn, err := readProxyHeader(server)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyHeader() = %v, want an error", conn.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader() error = %v", err)
+			}
+
+			wantAddr := tt.wantAddr
+			if wantAddr == "" {
+				wantAddr = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != wantAddr {
+				t.Errorf("RemoteAddr() = %s, want %s", got, wantAddr)
+			}
+			if rest, _ := io.ReadAll(conn); string(rest) != request {
+				t.Errorf("read %q after the header, want %q", rest, request)
+			}
+		})
+	}
+}
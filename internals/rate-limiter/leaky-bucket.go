@@ -0,0 +1,65 @@
+package ratelimiter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LeakyBucket admits requests at a steady rate. Every request adds one unit to the
+// bucket which drains at Rate units per second, a request that would overflow
+// Capacity is rejected. With Capacity 1 requests are spaced evenly no matter how
+// bursty the clients are
+type LeakyBucket struct {
+	Capacity int64
+	Rate     int64
+
+	level    float64 //units still in the bucket as of lastLeak
+	lastLeak time.Time
+	mutex    sync.Mutex
+}
+
+func NewLeakyBucket(rate, capacity int64) *LeakyBucket {
+	return &LeakyBucket{
+		Capacity: capacity,
+		Rate:     rate,
+		lastLeak: time.Now(), // Start with empty bucket
+	}
+}
+
+// leak drains what flowed out of the bucket since the last call
+func (lb *LeakyBucket) leak() {
+	now := time.Now()
+	lb.level -= now.Sub(lb.lastLeak).Seconds() * float64(lb.Rate)
+	if lb.level < 0 {
+		lb.level = 0
+	}
+	lb.lastLeak = now
+}
+
+// Allow adds the request to the bucket unless that would make it overflow
+func (lb *LeakyBucket) Allow() bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.leak()
+	if lb.level+1 > float64(lb.Capacity) {
+		return false
+	}
+	lb.level++
+	return true
+}
+
+// Enabled reports whether the bucket limits anything, a nil or zero sized bucket doesn't
+func (lb *LeakyBucket) Enabled() bool {
+	return lb != nil && lb.Capacity > 0
+}
+
+// Available returns how many more requests fit in the bucket right now
+func (lb *LeakyBucket) Available() int64 {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.leak()
+	return lb.Capacity - int64(math.Ceil(lb.level))
+}
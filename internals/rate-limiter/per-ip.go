@@ -0,0 +1,106 @@
+package ratelimiter
+
+import (
+	"sync"
+	"time"
+)
+
+// PerIPLimiter keeps a separate token bucket for every client ip so one noisy
+// client can't use up the limit of everyone else
+type PerIPLimiter struct {
+	Rate        int64         //tokens added per second to each ip bucket
+	MaxTokens   int64         //capacity of each ip bucket
+	IdleTimeout time.Duration //buckets not used for this long are evicted by the sweeper
+
+	buckets map[string]*ipBucket
+	mutex   sync.Mutex
+	stop    chan struct{}
+	once    sync.Once
+}
+
+const defaultIdleTimeout = 5 * time.Minute
+
+type ipBucket struct {
+	bucket   TokenBucket
+	lastSeen time.Time
+}
+
+func NewPerIPLimiter(rate, tokens int64, idleTimeout time.Duration) *PerIPLimiter {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	l := &PerIPLimiter{
+		Rate:        rate,
+		MaxTokens:   tokens,
+		IdleTimeout: idleTimeout,
+		buckets:     make(map[string]*ipBucket),
+		stop:        make(chan struct{}),
+	}
+	go l.sweep()
+	return l
+}
+
+// IsReqAllowed takes a token from the bucket of ip, creating the bucket on first use
+func (l *PerIPLimiter) IsReqAllowed(ip string) bool {
+	l.mutex.Lock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &ipBucket{bucket: RateLimiter(l.Rate, l.MaxTokens)}
+		l.buckets[ip] = b
+	}
+	b.lastSeen = time.Now()
+	l.mutex.Unlock()
+
+	return b.bucket.IsReqAllowed()
+}
+
+// Stats returns the number of ip buckets being tracked and how many of them are out of tokens,
+// a summary that doesn't grow with the number of clients
+func (l *PerIPLimiter) Stats() (buckets, exhausted int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, b := range l.buckets {
+		if b.bucket.Available() == 0 {
+			exhausted++
+		}
+	}
+	return len(l.buckets), exhausted
+}
+
+// Allow is the same as IsReqAllowed
+func (l *PerIPLimiter) Allow(ip string) bool {
+	return l.IsReqAllowed(ip)
+}
+
+// Enabled reports whether the limiter limits anything, a nil limiter or one with empty buckets doesn't
+func (l *PerIPLimiter) Enabled() bool {
+	return l != nil && l.MaxTokens > 0
+}
+
+// sweep periodically evicts buckets which haven't been touched within IdleTimeout
+func (l *PerIPLimiter) sweep() {
+	ticker := time.NewTicker(l.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.mutex.Lock()
+			for ip, b := range l.buckets {
+				if time.Since(b.lastSeen) > l.IdleTimeout {
+					delete(l.buckets, ip)
+				}
+			}
+			l.mutex.Unlock()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background sweeper, it is safe to call more than once
+func (l *PerIPLimiter) Close() {
+	l.once.Do(func() { close(l.stop) })
+}
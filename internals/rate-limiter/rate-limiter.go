@@ -1,11 +1,23 @@
 package ratelimiter
 
 import (
-	"math"
 	"sync"
 	"time"
 )
 
+// Limiter decides whether a request may go through, a nil Limiter means unlimited
+type Limiter interface {
+	Allow() bool
+}
+
+// TokenCounter is implemented by limiters which can tell how many requests they would let through right now
+type TokenCounter interface {
+	Available() int64
+}
+
+// TokenBucket lets Rate requests per second through with bursts of up to MaxTokens.
+// The fields are exported for compatibility only, use Allow, Available and Enabled
+// instead of reading them, how the bucket keeps its state may change
 type TokenBucket struct {
 	MaxTokens  int64
 	Tokens     int64
@@ -24,21 +36,38 @@ func RateLimiter(rate, tokens int64) TokenBucket {
 	}
 }
 
+// EmptyRateLimiter is RateLimiter with no tokens to begin with, the bucket fills at rate so
+// traffic ramps up instead of a full burst getting through right away
+func EmptyRateLimiter(rate, tokens int64) TokenBucket {
+	tb := RateLimiter(rate, tokens)
+	tb.Tokens = 0
+	return tb
+}
+
 // this method puts tokens in bucket
 func (tb *TokenBucket) refillBucket() {
 	now := time.Now()
 	elapsed := now.Sub(tb.LastRefill)
 
-	// Calculate tokens to add: rate is tokens per second
+	// Calculate whole tokens to add: rate is tokens per second
 	// Use float64 to avoid integer division truncation
-	secondsElapsed := elapsed.Seconds()
-	tokensToAdd := secondsElapsed * float64(tb.Rate)
+	tokensToAdd := int64(elapsed.Seconds() * float64(tb.Rate))
+	if tokensToAdd <= 0 {
+		// not even one token yet, keep LastRefill so the elapsed time keeps accumulating
+		return
+	}
 
-	// Add tokens (cap at MaxTokens)
-	newTokens := float64(tb.Tokens) + tokensToAdd
-	tb.Tokens = int64(math.Min(newTokens, float64(tb.MaxTokens)))
+	// Add tokens (cap at MaxTokens), a full bucket has no fraction worth carrying over
+	if tb.Tokens+tokensToAdd >= tb.MaxTokens {
+		tb.Tokens = tb.MaxTokens
+		tb.LastRefill = now
+		return
+	}
+	tb.Tokens += tokensToAdd
 
-	tb.LastRefill = now
+	// Only advance LastRefill by the time those whole tokens took, so the
+	// leftover fraction counts towards the next token instead of being lost
+	tb.LastRefill = tb.LastRefill.Add(time.Duration(tokensToAdd) * time.Second / time.Duration(tb.Rate))
 }
 
 // method to check is request allowed or should be dropped
@@ -53,3 +82,29 @@ func (tb *TokenBucket) IsReqAllowed() bool {
 	}
 	return false
 }
+
+// Wait blocks until a token is available and takes it, Rate must be positive
+func (tb *TokenBucket) Wait() {
+	for !tb.IsReqAllowed() {
+		time.Sleep(time.Second / time.Duration(tb.Rate))
+	}
+}
+
+// Available returns the tokens in the bucket after refilling it, without taking one
+func (tb *TokenBucket) Available() int64 {
+	tb.Mutex.Lock()
+	defer tb.Mutex.Unlock()
+
+	tb.refillBucket()
+	return tb.Tokens
+}
+
+// Allow makes TokenBucket a Limiter, it is the same as IsReqAllowed
+func (tb *TokenBucket) Allow() bool {
+	return tb.IsReqAllowed()
+}
+
+// Enabled reports whether the bucket limits anything, a nil or zero sized bucket doesn't
+func (tb *TokenBucket) Enabled() bool {
+	return tb != nil && tb.MaxTokens > 0
+}
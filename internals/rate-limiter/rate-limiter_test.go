@@ -0,0 +1,102 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    int64
+		max     int64
+		tokens  int64
+		elapsed time.Duration
+		want    int64
+	}{
+		{name: "no time passed", rate: 10, max: 5, tokens: 2, elapsed: 0, want: 2},
+		{name: "less than one token", rate: 10, max: 5, tokens: 0, elapsed: 50 * time.Millisecond, want: 0},
+		{name: "whole tokens", rate: 10, max: 5, tokens: 0, elapsed: 300 * time.Millisecond, want: 3},
+		{name: "fraction is not rounded up", rate: 10, max: 5, tokens: 0, elapsed: 190 * time.Millisecond, want: 1},
+		{name: "capped at max", rate: 10, max: 5, tokens: 4, elapsed: 10 * time.Second, want: 5},
+		{name: "zero rate never refills", rate: 0, max: 5, tokens: 1, elapsed: time.Hour, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := RateLimiter(tt.rate, tt.max)
+			tb.Tokens = tt.tokens
+			tb.LastRefill = time.Now().Add(-tt.elapsed)
+
+			if got := tb.Available(); got != tt.want {
+				t.Errorf("Available() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// the fraction of a token left after a refill must count towards the next one
+func TestTokenBucketKeepsFraction(t *testing.T) {
+	tb := EmptyRateLimiter(10, 5)
+	start := time.Now().Add(-150 * time.Millisecond)
+	tb.LastRefill = start
+
+	if got := tb.Available(); got != 1 {
+		t.Fatalf("after 150ms Available() = %d, want 1", got)
+	}
+	if want := start.Add(100 * time.Millisecond); !tb.LastRefill.Equal(want) {
+		t.Fatalf("LastRefill advanced by %s, want 100ms", tb.LastRefill.Sub(start))
+	}
+
+	// 150ms + 60ms is two tokens' worth, dropping the fraction would leave it at one
+	tb.LastRefill = tb.LastRefill.Add(-60 * time.Millisecond)
+	if got := tb.Available(); got != 2 {
+		t.Errorf("after another 60ms Available() = %d, want 2", got)
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	tests := []struct {
+		name       string
+		bucket     TokenBucket
+		wantPassed int
+	}{
+		{name: "full bucket lets a burst through", bucket: RateLimiter(1, 5), wantPassed: 5},
+		{name: "empty bucket lets nothing through", bucket: EmptyRateLimiter(1, 5), wantPassed: 0},
+		{name: "bucket of one", bucket: RateLimiter(1, 1), wantPassed: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passed := 0
+			for range 20 {
+				if tt.bucket.IsReqAllowed() {
+					passed++
+				}
+			}
+			if passed != tt.wantPassed {
+				t.Errorf("%d of 20 requests passed, want %d", passed, tt.wantPassed)
+			}
+		})
+	}
+}
+
+// hammering the bucket for a second admits the burst plus about rate requests, arrivals far
+// more frequent than one token's worth of time must not slow the refill down
+func TestTokenBucketRateUnderLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a second")
+	}
+
+	const rate = 10
+	tb := RateLimiter(rate, 1)
+	admitted := 0
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if tb.IsReqAllowed() {
+			admitted++
+		}
+	}
+
+	// the initial token plus rate refills, give or take one for timing
+	if admitted < rate || admitted > rate+2 {
+		t.Errorf("admitted %d requests in a second, want about %d", admitted, rate+1)
+	}
+}
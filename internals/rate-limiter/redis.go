@@ -0,0 +1,125 @@
+package ratelimiter
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisOptions configures the Redis server the token buckets of RedisLimiter live in
+type RedisOptions struct {
+	Addr      string        //host:port of the Redis server
+	Password  string        //empty when Redis doesn't require AUTH
+	DB        int           //database the bucket keys are stored in
+	KeyPrefix string        //prefix of every bucket key, instances using the same prefix share their limits
+	FailOpen  bool          //let requests through while Redis can't be reached, otherwise they are rejected
+	Timeout   time.Duration //deadline of each check, defaults to 100ms
+
+	// called with the error of the first check failing after one succeeded, so an outage
+	// is reported once instead of once per request. nil ignores errors
+	OnError func(err error)
+}
+
+// redisTokenBucket refills and takes from the bucket in KEYS[1] atomically, with the clock of
+// the Redis server so instances with skewed clocks still agree. The bucket expires once it
+// would be full again, an unused limiter leaves nothing behind unless rate is 0.
+// ARGV: rate per second, capacity, tokens of a new bucket
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = tonumber(ARGV[3])
+	ts = now
+end
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate)
+end
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+-- tostring keeps only 14 digits, too few for the microseconds of now
+redis.call('HSET', KEYS[1], 'tokens', string.format('%.6f', tokens), 'ts', string.format('%.6f', now))
+if rate > 0 then
+	redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate * 1000) + 1000)
+end
+return allowed
+`)
+
+// RedisClient holds the connections to Redis shared by the RedisLimiters created from it
+type RedisClient struct {
+	client  *redis.Client
+	opts    RedisOptions
+	failing atomic.Bool //the last check failed, OnError isn't called again until one succeeds
+}
+
+// NewRedisClient connects lazily, an unreachable server only shows up in the checks
+func NewRedisClient(opts RedisOptions) *RedisClient {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 100 * time.Millisecond
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+	return &RedisClient{client: client, opts: opts}
+}
+
+// Limiter returns the token bucket called name, letting rate requests per second through with
+// bursts of up to tokens across every instance sharing the key prefix. With startEmpty a bucket
+// which doesn't exist in Redis yet starts without tokens
+func (c *RedisClient) Limiter(name string, rate, tokens int64, startEmpty bool) *RedisLimiter {
+	initial := tokens
+	if startEmpty {
+		initial = 0
+	}
+	return &RedisLimiter{
+		client:  c,
+		key:     strings.TrimSuffix(c.opts.KeyPrefix, ":") + ":" + name,
+		rate:    rate,
+		tokens:  tokens,
+		initial: initial,
+	}
+}
+
+// Close closes the connections, the limiters created from c fail from then on
+func (c *RedisClient) Close() error {
+	return c.client.Close()
+}
+
+// RedisLimiter is a token bucket kept in Redis, so every server instance draws from the same bucket
+type RedisLimiter struct {
+	client  *RedisClient
+	key     string
+	rate    int64
+	tokens  int64
+	initial int64
+}
+
+// Allow takes a token from the bucket in Redis. When Redis can't be reached it follows FailOpen
+func (l *RedisLimiter) Allow() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), l.client.opts.Timeout)
+	defer cancel()
+
+	allowed, err := redisTokenBucket.Run(ctx, l.client.client, []string{l.key}, l.rate, l.tokens, l.initial).Int()
+	if err != nil {
+		if !l.client.failing.Swap(true) && l.client.opts.OnError != nil {
+			l.client.opts.OnError(err)
+		}
+		return l.client.opts.FailOpen
+	}
+	l.client.failing.Store(false)
+	return allowed == 1
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// environment variables Restart uses to talk to the new process. The first lists the listen
+// address of every passed listener, in order from fd 3, the second names the fd the new
+// process writes to once it is ready
+const (
+	listenFDsEnv = "TCPIE_LISTEN_FDS"
+	readyFDEnv   = "TCPIE_READY_FD"
+)
+
+// first fd after stdin, stdout and stderr, where exec puts ExtraFiles
+const firstExtraFD = 3
+
+// inheritedListener returns the listener the parent process passed for addr, nil when
+// there is none and a fresh one has to be bound
+func inheritedListener(addr string) (*net.TCPListener, error) {
+	passed := os.Getenv(listenFDsEnv)
+	if passed == "" {
+		return nil, nil
+	}
+
+	for i, passedAddr := range strings.Split(passed, ",") {
+		if passedAddr != addr {
+			continue
+		}
+
+		f := os.NewFile(uintptr(firstExtraFD+i), addr)
+		l, err := net.FileListener(f)
+		// FileListener works on a dup, the inherited fd isn't needed anymore
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to adopt inherited listener for %s: %w", addr, err)
+		}
+
+		tcpListener, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return nil, fmt.Errorf("inherited listener for %s is not TCP", addr)
+		}
+		return tcpListener, nil
+	}
+	return nil, nil
+}
+
+// Restarted reports whether this process was started by Restart and hasn't called NotifyReady yet
+func Restarted() bool {
+	return os.Getenv(readyFDEnv) != ""
+}
+
+// Restart starts a new copy of the running binary with the same arguments and hands it the
+// listening sockets, so connections keep being accepted while this process drains. It waits
+// up to timeout for the new process to call NotifyReady and kills it when it doesn't. On
+// success the caller is expected to Shutdown, the sockets stay open in the new process
+func (s *Server) Restart(timeout time.Duration) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("restart: %w", err)
+	}
+
+	files := make([]*os.File, 0, len(s.tcpListeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range s.tcpListeners {
+		f, err := l.File()
+		if err != nil {
+			return fmt.Errorf("restart: failed to pass listener %s: %w", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("restart: %w", err)
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+strings.Join(s.listenAddrs, ","),
+		readyFDEnv+"="+strconv.Itoa(firstExtraFD+len(files)-1),
+	)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("restart: failed to start new process: %w", err)
+	}
+	// only the new process may hold the write end, so the read sees EOF if it exits early
+	readyW.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-ready:
+		if err == nil {
+			s.logger.Info("new process is ready, handing over", "pid", cmd.Process.Pid)
+			return nil
+		}
+		err = fmt.Errorf("restart: new process exited before it was ready: %w", err)
+	case <-timer.C:
+		err = errors.New("restart: new process did not become ready in time")
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	return err
+}
+
+// NotifyReady tells the process which started this one with Restart that it is ready to take
+// over, it does nothing when the process wasn't started by Restart
+func NotifyReady() error {
+	fdValue := os.Getenv(readyFDEnv)
+	if fdValue == "" {
+		return nil
+	}
+	// a later Restart of this process sets its own values
+	os.Unsetenv(readyFDEnv)
+	os.Unsetenv(listenFDsEnv)
+
+	fd, err := strconv.Atoi(fdValue)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", readyFDEnv, fdValue, err)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		return fmt.Errorf("failed to notify parent process: %w", err)
+	}
+	return nil
+}
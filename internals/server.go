@@ -1,137 +1,1190 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/atharvamhaske/tcpie/internals/metrics"
 	ratelimiter "github.com/atharvamhaske/tcpie/internals/rate-limiter"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // for accepting tcp connections
 type Server struct {
-	WorkerPool
+	*WorkerPool
 	Port       int
 	URL        string
 	Opts       ServerOpts
 	Metrics    metrics.ServerMetrics
-	Listener   net.Listener
-	reqLimiter ratelimiter.TokenBucket
+	Listener   net.Listener              //listener on URL:Port
+	Listeners  []net.Listener            //every listener the server accepts on, Listener first
+	reqLimiter ratelimiter.Limiter       //nil when global rate limiting is disabled
+	ipLimiter  *ratelimiter.PerIPLimiter //nil when per ip limiting is disabled
+	ipFilter   *IPFilter                 //nil when every client ip may connect
+	closing    atomic.Bool               //set once shutdown starts so accept errors are expected
+	accepting  atomic.Bool               //set once the accept loops are running
+	lameDuck   atomic.Bool               //set while Shutdown waits out PreShutdownDelay, Ready is false but connections are still accepted
+	logger     *slog.Logger
+	openConns  atomic.Int64 //connections accepted and not closed yet, only counted with MaxConnections
+	connCount  atomic.Int64 //connections accepted by all listeners, used for conn ids
+
+	acceptLimiter *ratelimiter.TokenBucket //paces Accept calls of all listeners, nil when AcceptRate is 0
+	tcpListeners  []*net.TCPListener       //bare TCP listeners under Listeners, handed over by Restart
+	listenAddrs   []string                 //address each of Listeners was created for
+
+	limiterMutex sync.RWMutex //guards reqLimiter, Opts.Rate and Opts.Tokens which SetRateLimit replaces
+
+	stopOnce sync.Once //closes the listeners once, Drain and Shutdown can both get there
+
+	breaker *overloadBreaker //nil when Overload is disabled
+
+	redis *ratelimiter.RedisClient //connections of the redis limiters, nil unless RateLimitAlgorithm is AlgorithmRedis
+
+	ipConns     map[string]int //open connections per client ip, only counted with MaxConnectionsPerIP
+	ipConnMutex sync.Mutex
+
+	// parent of every job context, cancelled once in-flight connections are given up on:
+	// when Shutdown runs out of time or on Close
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// countedConn runs onClose exactly once when the connection is closed, whichever path closes it
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *countedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
 }
 
 type ServerOpts struct {
-	Rate       int64
-	Tokens     int64
-	MaxThreads int
-	QueueSize  int
+	Rate            int64
+	Tokens          int64
+	MaxThreads      int
+	QueueSize       int
+	ReadBufferSize  int
+	MaxRequestBytes int
+	MaxHeaderBytes  int    //request line and headers, bigger ones get 431, defaults to 1MB
+	TLSCertFile     string //TLS is enabled when both cert and key files are set
+	TLSKeyFile      string
+	TLSMinVersion   string //"1.0" to "1.3", defaults to 1.2
+
+	RateLimitAlgorithm  string //AlgorithmTokenBucket (default) or AlgorithmLeakyBucket for the global limiter
+	RateLimitStartEmpty bool   //global and route token buckets start without tokens and fill at their rate
+
+	// where the buckets of AlgorithmRedis live. Every instance with the same address and key
+	// prefix shares one global limit and one limit per route
+	RateLimitRedis ratelimiter.RedisOptions
+
+	MinWorkers        int           //workers kept when idle ones exit, only used with WorkerIdleTimeout
+	WorkerIdleTimeout time.Duration //workers idle this long exit and are respawned when jobs queue up, 0 disables
+
+	Network     string   //NetworkTCP (default), NetworkTCP4 or NetworkTCP6, the IP versions the listeners bind
+	ReusePort   bool     //set SO_REUSEPORT so several processes can bind the same port
+	TCPDelay    bool     //keep Nagle's algorithm on, by default TCP_NODELAY is set on accepted connections
+	ExtraListen []string //more host:port addresses to accept on, all feed the same worker pool
+
+	TCPKeepAlivePeriod time.Duration //interval of TCP keep-alive probes, 0 uses the Go default (15s) and negative disables them
+	ListenBacklog      int           //length of the kernel accept queue, 0 keeps the system default, the kernel caps larger values
+
+	PerIPRate        int64 //per ip limiting is enabled when PerIPTokens > 0
+	PerIPTokens      int64
+	PerIPIdleTimeout time.Duration
+
+	Handler        Handler      //builds the response for each request, defaults to Hello world
+	AllowedMethods []string     //methods passed to Handler, others get 405, empty allows any method
+	Middleware     []Middleware //wrapped around Handler in order, the first one sees a request first
+	Auth           AuthOptions  //credentials required for Handler, the exporter routes stay open for probes
+	Logger         *slog.Logger //defaults to slog.Default()
+	LogSampleRate  int          //log per request debug lines for 1 in N connections
+	KeepAlive      bool         //serve more than one request per connection
+
+	// read, write, idle and handler timeouts and the connection lifetime cap, see DefaultTimeouts
+	Timeouts
+
+	MaxWorkersPerCPU int //clamps MaxThreads to this many workers per cpu, 0 only logs a warning for suspicious counts
+
+	// requests for ExporterPaths are served by ExporterHandler instead of Handler, so the
+	// metrics endpoint can share the main port. ExporterDebugPaths are served by it too but
+	// only with the credentials of Auth, they expose internals and can drain the server
+	ExporterHandler    http.Handler
+	ExporterPaths      []string
+	ExporterDebugPaths []string
+
+	ResponseDelay       time.Duration //artificial latency added before every response, for testing client timeouts
+	ResponseDelayJitter time.Duration //random extra latency between 0 and this
+
+	QueueFullTimeout time.Duration //how long to wait for a free queue slot before 503, 0 rejects immediately
+	OverflowPolicy   string        //OverflowDropNew (default) or OverflowDropOld, which job a full queue rejects
+	DrainTimeout     time.Duration //how long Shutdown lets workers finish before force closing connections
+	PreShutdownDelay time.Duration //how long Shutdown keeps accepting with Ready false before it stops, 0 stops right away
+	MaxConnections   int           //open connections allowed at once, 0 means no limit
+	AcceptRate       int64         //connections taken off the listeners per second, the rest wait in the backlog; 0 means no limit
+
+	AcceptLoops int //goroutines accepting on each listener, all feeding the same worker pool; 0 means 1
+
+	// open connections allowed from one client ip, 0 means no limit. Not applied with ProxyProtocol,
+	// the accept loop only sees the balancer address there
+	MaxConnectionsPerIP int
+
+	ServerHeader string //sent as the Server header on every response, empty leaves the header out
+
+	// client ips allowed to connect and those that are not, in CIDR notation. Denied wins over allowed,
+	// an empty AllowCIDRs allows every ip not denied. Other clients are disconnected right after accept,
+	// with ProxyProtocol once the header named the real client
+	AllowCIDRs []string
+	DenyCIDRs  []string
+
+	// header carrying the request id, e.g. X-Request-ID. An id sent by the client is kept, otherwise
+	// one is generated; it is echoed on the response and logged. Empty disables request ids
+	RequestIDHeader string
+
+	// requests arriving slower than MinReadRate bytes per second, measured from the start of the
+	// request once MinReadRateGrace passed, get 408 and their connection is closed. 0 disables it
+	MinReadRate      int
+	MinReadRateGrace time.Duration
+
+	ResetRate            float64 //fraction of requests answered by resetting the connection (RST), from 0 to 1
+	ResetWithoutResponse bool    //reset without sending the response first, like a backend crashing mid request
+
+	AccessLog *AccessLog //one line per answered request, see NewAccessLog; nil disables it
+
+	Compression         string //CompressionGzip or CompressionNone (default)
+	CompressionMinBytes int    //bodies smaller than this are sent uncompressed
+
+	ForceStatus int     //answer every request with this status instead of calling Handler, 0 disables it
+	ErrorRate   float64 //fraction of requests answered with 500 instead of calling Handler, from 0 to 1
+
+	ProxyProtocol bool //expect a PROXY protocol header on every connection, for use behind a load balancer
+
+	MetricPaths []string     //request paths labeled as is in metrics, everything else is "other"
+	Tracer      trace.Tracer //traces every request when set, see the tracing package
+
+	Overload OverloadOptions //rejects connections with BusyResponse while the queue stays too full
+
+	RateLimitResponse RejectResponse //sent when a rate limiter rejects a connection or a request
+	RouteLimits       []RouteLimit   //own buckets for matching request paths, checked after the global limit
+	BusyResponse      RejectResponse //sent when the worker pool queue is full
+}
+
+// RouteLimit gives the requests whose path matches Pattern a bucket of their own
+type RouteLimit struct {
+	Pattern string //exact path or path.Match pattern, e.g. /api/*
+	Rate    int64
+	Tokens  int64
+}
+
+// RejectResponse is sent to clients turned away before a worker serves them,
+// a zero Status or empty Body keeps the default
+type RejectResponse struct {
+	Status     int
+	Body       string
+	RetryAfter time.Duration //sent as Retry-After, when 0 rate limits derive it from the refill rate and other rejections leave it out
+}
+
+var (
+	defaultRateLimitResponse = RejectResponse{Status: http.StatusTooManyRequests, Body: "Rate limit exceeded"}
+	defaultBusyResponse      = RejectResponse{Status: http.StatusServiceUnavailable, Body: "Server busy, try again later"}
+)
+
+// withDefaults fills the zero fields of r from def
+func (r RejectResponse) withDefaults(def RejectResponse) RejectResponse {
+	if r.Status == 0 {
+		r.Status = def.Status
+	}
+	if r.Body == "" {
+		r.Body = def.Body
+	}
+	if r.RetryAfter == 0 {
+		r.RetryAfter = def.RetryAfter
+	}
+	return r
+}
+
+// headers returns the Retry-After header for retryAfter, nil when it is 0
+func (r RejectResponse) headers(retryAfter time.Duration) map[string]string {
+	if retryAfter <= 0 {
+		return nil
+	}
+	return map[string]string{"Retry-After": strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))}
+}
+
+// refillInterval is how long a bucket refilling rate tokens per second takes to get one token back,
+// 0 when it never refills
+func refillInterval(rate int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(rate)
+}
+
+// rateLimitResponse builds the response for a client rejected by a bucket refilling rate tokens per second
+func (s *Server) rateLimitResponse(rate int64) []byte {
+	retryAfter := s.Opts.RateLimitResponse.RetryAfter
+	if retryAfter == 0 {
+		retryAfter = refillInterval(rate)
+	}
+	return s.reject(s.Opts.RateLimitResponse, retryAfter)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// listenAddr builds the bind address, IPv6 literals get bracketed and an empty url binds all interfaces
+func listenAddr(url string, port int) string {
+	return net.JoinHostPort(strings.Trim(url, "[]"), strconv.Itoa(port))
+}
+
+// tcpOptionsListener sets socket options on every accepted connection which the listen config
+// can't: Nagle's algorithm (Go sets TCP_NODELAY by default) and the keep-alive period of
+// listeners inherited from a parent process
+type tcpOptionsListener struct {
+	net.Listener
+	delay     bool
+	keepAlive time.Duration //0 leaves keep-alive as it is
+}
+
+func (l tcpOptionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if l.delay {
+			tcpConn.SetNoDelay(false)
+		}
+		if l.keepAlive > 0 {
+			tcpConn.SetKeepAlivePeriod(l.keepAlive)
+		} else if l.keepAlive < 0 {
+			tcpConn.SetKeepAlive(false)
+		}
+	}
+	return conn, nil
+}
+
+// createListener creates a TCP listener for the given address, wrapped in TLS when tlsCfg is not nil.
+// A listener handed over by the parent process for addr is adopted instead of binding a new one.
+// The bare TCP listener is returned too, it is what Restart passes on
+func createListener(addr string, opts ServerOpts, tlsCfg *tls.Config) (net.Listener, *net.TCPListener, error) {
+	tcpListener, err := inheritedListener(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	inherited := tcpListener != nil
+
+	if !inherited {
+		// KeepAlive applies to every accepted connection
+		lc := net.ListenConfig{KeepAlive: opts.TCPKeepAlivePeriod}
+		if opts.ReusePort {
+			lc.Control = reusePortControl
+		}
+
+		l, err := lc.Listen(context.Background(), opts.Network, addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create listener on %s: %w", addr, err)
+		}
+		tcpListener = l.(*net.TCPListener)
+	}
+
+	if opts.ListenBacklog > 0 {
+		if err := setListenBacklog(tcpListener, opts.ListenBacklog); err != nil {
+			tcpListener.Close()
+			return nil, nil, fmt.Errorf("failed to set listen backlog on %s: %w", addr, err)
+		}
+	}
+
+	// below TLS so the options are set on the raw TCP connection
+	var listener net.Listener = tcpListener
+	if opts.TCPDelay || (inherited && opts.TCPKeepAlivePeriod != 0) {
+		optsListener := tcpOptionsListener{Listener: listener, delay: opts.TCPDelay}
+		if inherited {
+			optsListener.keepAlive = opts.TCPKeepAlivePeriod
+		}
+		listener = optsListener
+	}
+
+	if tlsCfg != nil {
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+
+	return listener, tcpListener, nil
+}
+
+// createTLSConfig loads the certificate pair from opts, it returns nil when TLS is not configured
+func createTLSConfig(opts ServerOpts) (*tls.Config, error) {
+	if opts.TLSCertFile == "" && opts.TLSKeyFile == "" {
+		return nil, nil
+	}
+	if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+		return nil, errors.New("tls requires both cert_file and key_file to be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls key pair: %w", err)
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if opts.TLSMinVersion != "" {
+		v, ok := tlsVersions[opts.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tls min_version %q", opts.TLSMinVersion)
+		}
+		minVersion = v
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}, nil
+}
+
+func createWorkerPool(opts ServerOpts, metrics metrics.ServerMetrics, ipLimiter *ratelimiter.PerIPLimiter, ipFilter *IPFilter, routeLimiters []RouteLimiter, compress Middleware) *WorkerPool {
+	ipLimitResponse := opts.RateLimitResponse
+	if ipLimitResponse.RetryAfter == 0 {
+		ipLimitResponse.RetryAfter = refillInterval(opts.PerIPRate)
+	}
+
+	// behind a balancer the accept loop only sees the balancer address, the
+	// per ip checks move to the workers which see the real client address
+	if !opts.ProxyProtocol {
+		ipLimiter, ipFilter = nil, nil
+	}
+
+	return NewWorkerPool(opts.MaxThreads, opts.QueueSize, WorkerOpts{
+		ReadBufferSize:  opts.ReadBufferSize,
+		MaxRequestBytes: opts.MaxRequestBytes,
+		MaxHeaderBytes:  opts.MaxHeaderBytes,
+		Handler:         opts.Handler,
+		KeepAlive:       opts.KeepAlive,
+		Metrics:         metrics,
+		Logger:          opts.Logger,
+		LogSampleRate:   opts.LogSampleRate,
+
+		Timeouts: opts.Timeouts,
+
+		Tracer:            opts.Tracer,
+		WorkerIdleTimeout: opts.WorkerIdleTimeout,
+		MinWorkers:        opts.MinWorkers,
+
+		ProxyProtocol:   opts.ProxyProtocol,
+		MetricPaths:     opts.MetricPaths,
+		IPLimiter:       ipLimiter,
+		IPFilter:        ipFilter,
+		IPLimitResponse: ipLimitResponse,
+		RouteLimiters:   routeLimiters,
+
+		ResponseDelay:       opts.ResponseDelay,
+		ResponseDelayJitter: opts.ResponseDelayJitter,
+
+		MaxWorkersPerCPU: opts.MaxWorkersPerCPU,
+
+		AccessLog: opts.AccessLog,
+
+		ServerHeader: opts.ServerHeader,
+
+		RequestIDHeader: opts.RequestIDHeader,
+
+		MinReadRate:      opts.MinReadRate,
+		MinReadRateGrace: opts.MinReadRateGrace,
+
+		ResetRate:            opts.ResetRate,
+		ResetWithoutResponse: opts.ResetWithoutResponse,
+
+		// the metrics and probe routes skip auth and the method check so probes work without
+		// credentials, the debug routes skip only the method check. Compression comes first so
+		// it also covers them and every error response
+		Middleware: append(slices.Clip(opts.Middleware),
+			compress,
+			routeToHTTP(opts.ExporterHandler, opts.ExporterPaths),
+			requireAuth(opts.Auth),
+			routeToHTTP(opts.ExporterHandler, opts.ExporterDebugPaths),
+			allowMethods(opts.AllowedMethods),
+			injectFaults(opts.ForceStatus, opts.ErrorRate),
+		),
+	})
+}
+
+// rate limiting algorithms the global limiter can use
+const (
+	AlgorithmTokenBucket = "token_bucket" //allows bursts up to the bucket size
+	AlgorithmLeakyBucket = "leaky_bucket" //smooths requests out to a constant rate
+	AlgorithmRedis       = "redis"        //token bucket kept in Redis, shared by every instance using RateLimitRedis
+)
+
+// createRateLimiter returns the global limiter, nil (unlimited) when no tokens are configured.
+// An empty algorithm is a token bucket, startEmpty is only supported by the token buckets.
+// AlgorithmRedis keeps the bucket called name in redis, which must not be nil then
+func createRateLimiter(algorithm string, rate, tokens int64, startEmpty bool, redis *ratelimiter.RedisClient, name string) (ratelimiter.Limiter, error) {
+	if tokens <= 0 {
+		return nil, nil
+	}
+
+	switch algorithm {
+	case "", AlgorithmTokenBucket:
+		bucket := ratelimiter.RateLimiter(rate, tokens)
+		if startEmpty {
+			bucket = ratelimiter.EmptyRateLimiter(rate, tokens)
+		}
+		return &bucket, nil
+	case AlgorithmLeakyBucket:
+		if startEmpty {
+			return nil, errors.New("starting empty is only supported by the token bucket")
+		}
+		return ratelimiter.NewLeakyBucket(rate, tokens), nil
+	case AlgorithmRedis:
+		return redis.Limiter(name, rate, tokens, startEmpty), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+}
+
+// networks the listeners can bind
+const (
+	NetworkTCP  = "tcp"  //IPv4 and IPv6, a wildcard address is dual stack where the platform allows it
+	NetworkTCP4 = "tcp4" //IPv4 only
+	NetworkTCP6 = "tcp6" //IPv6 only
+)
+
+// what happens to a new connection when the queue is full
+const (
+	OverflowDropNew = "drop_new" //reject the new connection
+	OverflowDropOld = "drop_old" //reject the connection queued longest, its client may have given up already
+)
+
+// response compressions the workers can apply
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip" //for clients sending Accept-Encoding: gzip
+)
+
+// createCompression returns the middleware compressing response bodies of at least minSize bytes
+func createCompression(compression string, minSize int) (Middleware, error) {
+	switch compression {
+	case "", CompressionNone:
+		return passThrough, nil
+	case CompressionGzip:
+		return compressGzip(minSize), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// createRouteLimiters creates a limiter for every route limit, using the algorithm of the global limiter
+func createRouteLimiters(opts ServerOpts, redis *ratelimiter.RedisClient) ([]RouteLimiter, error) {
+	routeLimiters := make([]RouteLimiter, 0, len(opts.RouteLimits))
+	for _, route := range opts.RouteLimits {
+		if _, err := path.Match(route.Pattern, "/"); err != nil {
+			return nil, fmt.Errorf("invalid route pattern %q: %w", route.Pattern, err)
+		}
+		limiter, err := createRateLimiter(opts.RateLimitAlgorithm, route.Rate, route.Tokens, opts.RateLimitStartEmpty, redis, "route:"+route.Pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		response := opts.RateLimitResponse
+		if response.RetryAfter == 0 {
+			response.RetryAfter = refillInterval(route.Rate)
+		}
+		routeLimiters = append(routeLimiters, RouteLimiter{Pattern: route.Pattern, Limiter: limiter, Response: response})
+	}
+	return routeLimiters, nil
+}
+
+// createRedisClient returns the client the redis limiters share, nil unless the algorithm is
+// AlgorithmRedis. A failing redis is logged once per outage
+func createRedisClient(opts ServerOpts) *ratelimiter.RedisClient {
+	if opts.RateLimitAlgorithm != AlgorithmRedis {
+		return nil
+	}
+	redisOpts := opts.RateLimitRedis
+	if redisOpts.OnError == nil {
+		redisOpts.OnError = func(err error) {
+			opts.Logger.Warn("redis rate limiter failing", "addr", redisOpts.Addr, "fail_open", redisOpts.FailOpen, "err", err)
+		}
+	}
+	return ratelimiter.NewRedisClient(redisOpts)
+}
+
+// closeRedis closes the connections of the redis limiters when there are any
+func closeRedis(logger *slog.Logger, redis *ratelimiter.RedisClient) {
+	if redis == nil {
+		return
+	}
+	if err := redis.Close(); err != nil {
+		logger.Warn("failed to close the redis connections", "err", err)
+	}
 }
 
-// createListener creates a TCP listener for the given address
-func createListener(url string, port int) (net.Listener, error) {
-	addr := fmt.Sprintf("%s:%d", url, port)
+// createAcceptLimiter returns the bucket pacing Accept, it holds a second worth of
+// connections so short bursts go through without waiting
+func createAcceptLimiter(rate int64) *ratelimiter.TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	bucket := ratelimiter.RateLimiter(rate, rate)
+	return &bucket
+}
+
+func createPerIPLimiter(opts ServerOpts) *ratelimiter.PerIPLimiter {
+	if opts.PerIPTokens <= 0 {
+		return nil
+	}
+	return ratelimiter.NewPerIPLimiter(opts.PerIPRate, opts.PerIPTokens, opts.PerIPIdleTimeout)
+}
 
-	listener, err := net.Listen("tcp", addr)
+// clientIP returns the ip part of the remote address of conn
+func clientIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create listener on %s: %w", addr, err)
+		return addr
+	}
+	return host
+}
+
+// allowRequest checks the bucket of the client ip first and then the global bucket,
+// so a client over its own limit doesn't use up global tokens. With ProxyProtocol
+// the per ip check is done by the worker once the real client address is known.
+// When the request is rejected it also returns the refill rate of the bucket that rejected it
+// and the rejection reason
+func (s *Server) allowRequest(client net.Conn) (int64, string, bool) {
+	if s.ipLimiter.Enabled() && !s.Opts.ProxyProtocol && !s.ipLimiter.Allow(clientIP(client)) {
+		return s.Opts.PerIPRate, reasonPerIPLimit, false
+	}
+
+	s.limiterMutex.RLock()
+	limiter, rate := s.reqLimiter, s.Opts.Rate
+	s.limiterMutex.RUnlock()
+	if limiter == nil {
+		return 0, "", true
 	}
+	// every accept loop goes through the limiter's mutex, the histogram shows when they queue up on it
+	start := time.Now()
+	allowed := limiter.Allow()
+	s.Metrics.LimiterCheck.Observe(time.Since(start).Seconds())
+	if !allowed {
+		return rate, reasonRateLimited, false
+	}
+	return 0, "", true
+}
 
-	return listener, nil
+// reasons of the rejections_total metric, total_requests keeps its own rejected_ outcomes
+const (
+	reasonRateLimited   = "rate_limited"
+	reasonPerIPLimit    = "per_ip_limit"
+	reasonMaxConns      = "max_connections"
+	reasonMaxConnsPerIP = "max_connections_per_ip"
+	reasonOverload      = "overload"
+	reasonQueueFull     = "queue_full"
+	reasonEvicted       = "evicted" //dropped from the queue by OverflowDropOld, already counted as processed in total_requests
+	reasonShuttingDown  = "shutting_down"
+	reasonBadProxy      = "bad_proxy_header"
+	reasonIPDenied      = "ip_denied"
+)
+
+// rejectConn answers a connection that won't be queued with response and closes it, a nil
+// response closes it without writing anything. It is counted as outcome in total_requests
+// and as reason in rejections_total
+func (s *Server) rejectConn(client net.Conn, connID int64, outcome, reason string, response []byte) {
+	s.Metrics.Requests.WithLabelValues(outcome).Inc()
+	s.Metrics.Rejections.WithLabelValues(reason).Inc()
+	if response != nil {
+		// runs on the accept loop, over TLS the write does the whole handshake first
+		client.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		client.Write(response)
+	}
+	client.Close()
+	s.logger.Warn("request rejected", "conn_id", connID, "remote_addr", client.RemoteAddr().String(), "reason", reason)
 }
 
-func createWorkerPool(maxWorkers, queueSize int) *WorkerPool {
-	return NewWorkerPool(maxWorkers, queueSize)
+// dropOldest takes the job which waited longest off the queue and rejects it with BusyResponse,
+// it returns false when the workers emptied the queue in the meantime. The job was counted as
+// processed when it was queued, so it is counted as evicted rather than queue_full: the queue_full
+// rejections and the processed connections stay disjoint
+func (s *Server) dropOldest() bool {
+	var old Job
+	select {
+	case old = <-s.JobChan:
+	default:
+		return false
+	}
+
+	s.Metrics.ActiveConnections.Dec()
+	s.Metrics.Rejections.WithLabelValues(reasonEvicted).Inc()
+	s.recordStatus(s.Opts.BusyResponse.Status)
+	old.Conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	old.Conn.Write(s.reject(s.Opts.BusyResponse, s.Opts.BusyResponse.RetryAfter))
+	old.Conn.Close()
+	s.logger.Warn("request rejected", "conn_id", old.Id, "remote_addr", old.Conn.RemoteAddr().String(), "reason", reasonEvicted, "overflow_policy", OverflowDropOld)
+	return true
 }
 
-func createRateLimiter(rate, tokens int64) ratelimiter.TokenBucket {
-	return ratelimiter.RateLimiter(rate, tokens)
+// acquireIPConn counts a new connection from ip, it returns false without counting it
+// when ip already has MaxConnectionsPerIP open
+func (s *Server) acquireIPConn(ip string) bool {
+	s.ipConnMutex.Lock()
+	defer s.ipConnMutex.Unlock()
+
+	if s.ipConns[ip] >= s.Opts.MaxConnectionsPerIP {
+		return false
+	}
+	s.ipConns[ip]++
+	return true
+}
+
+// releaseIPConn uncounts a closed connection from ip, ips without open connections are forgotten
+func (s *Server) releaseIPConn(ip string) {
+	s.ipConnMutex.Lock()
+	defer s.ipConnMutex.Unlock()
+
+	if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+}
+
+// SetRateLimit replaces the global rate limiter while the server is running, tokens <= 0
+// disables it. The new limiter starts from scratch and keeps the configured algorithm and RateLimitStartEmpty
+func (s *Server) SetRateLimit(rate, tokens int64) error {
+	limiter, err := createRateLimiter(s.Opts.RateLimitAlgorithm, rate, tokens, s.Opts.RateLimitStartEmpty, s.redis, "global")
+	if err != nil {
+		return err
+	}
+
+	s.limiterMutex.Lock()
+	s.reqLimiter = limiter
+	s.Opts.Rate, s.Opts.Tokens = rate, tokens
+	s.limiterMutex.Unlock()
+	return nil
+}
+
+// enqueue puts job on the worker pool channel. When the channel is full it waits up to
+// QueueFullTimeout for a slot, so short bursts aren't rejected straight away. The
+// returned reason is the metric label value used when the job was not queued
+func (s *Server) enqueue(job Job) (string, bool) {
+	// held for the whole send, so Close can't close JobChan with a job on its way in
+	s.sendMutex.RLock()
+	defer s.sendMutex.RUnlock()
+
+	select {
+	case <-s.WorkerPool.done:
+		return "rejected_shutdown", false
+	default:
+	}
+
+	select {
+	case s.JobChan <- job:
+		return "", true
+	default:
+	}
+	// counted even when waiting for QueueFullTimeout gets the job in, the pool was at capacity either way
+	s.Metrics.PoolSaturated.Inc()
+
+	if s.Opts.OverflowPolicy == OverflowDropOld && s.dropOldest() {
+		select {
+		case s.JobChan <- job:
+			return "", true
+		default:
+			// another accept loop took the freed slot
+		}
+	}
+
+	if s.Opts.QueueFullTimeout <= 0 {
+		return "rejected_queue_full", false
+	}
+
+	// acceptTimeout path, this also holds back the accept loop which is the backpressure we want
+	timer := time.NewTimer(s.Opts.QueueFullTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.JobChan <- job:
+		return "", true
+	case <-s.WorkerPool.done:
+		return "rejected_shutdown", false
+	case <-timer.C:
+		return "rejected_timeout", false
+	}
 }
 
-func handleRequests(s *Server) {
-	log.Println("start handling requests")
+// backoff bounds between failed accepts
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// nextAcceptDelay doubles the delay after a failed accept, starting at minAcceptDelay
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	return min(delay*2, maxAcceptDelay)
+}
 
-	var connCount int64
+// handleRequests is an accept loop of one listener, every listener runs AcceptLoops of them
+func handleRequests(s *Server, listener net.Listener) {
+	s.logger.Info("start handling requests", "addr", listener.Addr().String())
 
+	var acceptDelay time.Duration
 	for {
-		client, err := s.Listener.Accept()
+		// waiting before Accept leaves the excess connections in the kernel backlog
+		// instead of accepting them just to reject them
+		if s.acceptLimiter.Enabled() {
+			s.acceptLimiter.Wait()
+		}
+
+		client, err := listener.Accept()
 		if err != nil {
-			log.Fatalf("accept error: %v", err)
+			if s.closing.Load() {
+				s.logger.Info("listener closed, stop handling requests", "addr", listener.Addr().String())
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				s.logger.Error("listener closed unexpectedly, stop handling requests", "addr", listener.Addr().String())
+				return
+			}
+
+			// anything else (EMFILE, ECONNABORTED, ...) is expected to pass, back off so a
+			// burst of errors doesn't spin the loop
+			acceptDelay = nextAcceptDelay(acceptDelay)
+			s.logger.Warn("accept error, retrying", "addr", listener.Addr().String(), "err", err, "delay", acceptDelay)
+			time.Sleep(acceptDelay)
+			continue
 		}
+		acceptDelay = 0
+		accepted := time.Now()
 
-		connID := atomic.AddInt64(&connCount, 1)
+		connID := s.connCount.Add(1)
 
-		// Check rate limiter if configured
-		if s.reqLimiter.MaxTokens > 0 && !s.reqLimiter.IsReqAllowed() {
-			response := []byte("HTTP/1.1 429 Too Many Requests\r\nConnection: close\r\nContent-Length: 20\r\n\r\nRate limit exceeded")
-			client.Write(response)
-			client.Close()
-			log.Printf("Request %d rate limited", connID)
+		// first, a client that may not connect shouldn't count against any limit. It gets no
+		// response, over TLS even that would mean a handshake
+		if s.ipFilter.Enabled() && !s.Opts.ProxyProtocol && !s.ipFilter.Allowed(clientIP(client)) {
+			s.rejectConn(client, connID, "rejected_ip_denied", reasonIPDenied, nil)
 			continue
 		}
 
-		// Submit job to worker pool (non-blocking)
-		// Handle panic if channel is closed
-		job := Job{Id: int(connID), Conn: client}
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					// Channel is closed - server is shutting down
-					response := []byte("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 28\r\n\r\nServer shutting down")
-					client.Write(response)
-					client.Close()
-					log.Printf("Request %d rejected - server shutting down", connID)
-				}
-			}()
+		// Bound the connections open at once, counted from accept until the conn is closed
+		if s.Opts.MaxConnections > 0 {
+			if s.openConns.Add(1) > int64(s.Opts.MaxConnections) {
+				s.openConns.Add(-1)
+				s.rejectConn(client, connID, "rejected_max_connections", reasonMaxConns,
+					s.response(http.StatusServiceUnavailable, nil, []byte("Too many connections"), false))
+				continue
+			}
+			client = &countedConn{Conn: client, onClose: func() { s.openConns.Add(-1) }}
+		}
 
-			select {
-			case s.JobChan <- job:
-				// Job accepted - increment metrics
-				s.Metrics.Requests.WithLabelValues("processed").Inc()
-			default:
-				// Worker pool is full - reject request
-				response := []byte("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 28\r\n\r\nServer busy, try again later")
-				client.Write(response)
-				client.Close()
-				log.Printf("Request %d rejected - server busy (queue full)", connID)
+		// one host holding many slow connections is caught here, its requests alone may be few
+		if s.Opts.MaxConnectionsPerIP > 0 && !s.Opts.ProxyProtocol {
+			ip := clientIP(client)
+			if !s.acquireIPConn(ip) {
+				s.rejectConn(client, connID, "rejected_max_connections_per_ip", reasonMaxConnsPerIP,
+					s.response(http.StatusServiceUnavailable, nil, []byte("Too many connections"), false))
+				continue
 			}
-		}()
+			client = &countedConn{Conn: client, onClose: func() { s.releaseIPConn(ip) }}
+		}
+
+		// Check rate limiters if configured
+		if rate, reason, ok := s.allowRequest(client); !ok {
+			s.rejectConn(client, connID, "rejected_rate_limit", reason, s.rateLimitResponse(rate))
+			continue
+		}
+
+		// shed load while the queue has been too full for too long, instead of queueing work
+		// that would only time out
+		if ok, retryAfter := s.checkOverload(); !ok {
+			if s.Opts.BusyResponse.RetryAfter > 0 {
+				retryAfter = s.Opts.BusyResponse.RetryAfter
+			}
+			s.rejectConn(client, connID, "rejected_overload", reasonOverload, s.reject(s.Opts.BusyResponse, retryAfter))
+			continue
+		}
+
+		// Submit job to worker pool (non-blocking unless QueueFullTimeout is set)
+		job := Job{Id: int(connID), Conn: client, Accepted: accepted, Enqueued: time.Now(), Ctx: s.ctx}
+
+		// counted before the send so a fast worker can't decrement it first
+		s.Metrics.ActiveConnections.Inc()
+		reason, ok := s.enqueue(job)
+		s.Metrics.QueueDepth.Set(float64(len(s.JobChan)))
+		if ok {
+			// Job accepted - increment metrics
+			s.Metrics.Requests.WithLabelValues("processed").Inc()
+			s.WorkerPool.grow()
+			continue
+		}
+
+		s.Metrics.ActiveConnections.Dec()
+		if reason == "rejected_shutdown" {
+			s.rejectConn(client, connID, reason, reasonShuttingDown,
+				s.response(http.StatusServiceUnavailable, nil, []byte("Server shutting down"), false))
+		} else {
+			// Worker pool is full - reject request
+			s.rejectConn(client, connID, reason, reasonQueueFull, s.reject(s.Opts.BusyResponse, s.Opts.BusyResponse.RetryAfter))
+		}
 	}
 }
 
-// NewServer creates a new server instance with all components initialized
+// NewServer creates a new server instance with all components initialized, it is kept for
+// compatibility and delegates to New
 func NewServer(url string, port int, opts ServerOpts, metrics metrics.ServerMetrics) (*Server, error) {
-	// Create listener
-	listener, err := createListener(url, port)
+	return New(Config{URL: url, Port: port, ServerOpts: opts}, WithMetrics(metrics))
+}
+
+// newServer builds the server once New has applied the options and defaults
+func newServer(url string, port int, opts ServerOpts, metrics metrics.ServerMetrics) (*Server, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	opts.RateLimitResponse = opts.RateLimitResponse.withDefaults(defaultRateLimitResponse)
+	opts.BusyResponse = opts.BusyResponse.withDefaults(defaultBusyResponse)
+	if err := opts.Timeouts.Validate(); err != nil {
+		return nil, err
+	}
+	switch opts.Network {
+	case "":
+		opts.Network = NetworkTCP
+	case NetworkTCP, NetworkTCP4, NetworkTCP6:
+	default:
+		return nil, fmt.Errorf("unknown network %q, must be tcp, tcp4 or tcp6", opts.Network)
+	}
+	ipFilter, err := NewIPFilter(opts.AllowCIDRs, opts.DenyCIDRs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create listener: %w", err)
+		return nil, err
 	}
 
-	// Create worker pool
-	workerPool := createWorkerPool(opts.MaxThreads, opts.QueueSize)
+	tlsCfg, err := createTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil && opts.ProxyProtocol {
+		// the listener terminates TLS, it would take the PROXY header for a broken ClientHello
+		return nil, errors.New("ProxyProtocol can't be used together with TLS")
+	}
+
+	// Create listeners, the main one on url:port and then the extra addresses
+	addrs := append([]string{listenAddr(url, port)}, opts.ExtraListen...)
+	var listeners []net.Listener
+	var tcpListeners []*net.TCPListener
+	for _, addr := range addrs {
+		l, tcpListener, err := createListener(addr, opts, tlsCfg)
+		if err != nil {
+			closeListeners(opts.Logger, listeners)
+			return nil, fmt.Errorf("failed to create listener: %w", err)
+		}
+		listeners = append(listeners, l)
+		tcpListeners = append(tcpListeners, tcpListener)
+	}
+
+	compress, err := createCompression(opts.Compression, opts.CompressionMinBytes)
+	if err != nil {
+		closeListeners(opts.Logger, listeners)
+		return nil, err
+	}
+	switch opts.OverflowPolicy {
+	case "", OverflowDropNew, OverflowDropOld:
+	default:
+		closeListeners(opts.Logger, listeners)
+		return nil, fmt.Errorf("unknown overflow policy %q", opts.OverflowPolicy)
+	}
+
+	// the global and the route limiters share the connections to redis
+	redisClient := createRedisClient(opts)
+	routeLimiters, err := createRouteLimiters(opts, redisClient)
+	if err != nil {
+		closeListeners(opts.Logger, listeners)
+		closeRedis(opts.Logger, redisClient)
+		return nil, err
+	}
+	// Create rate limiter, before anything starting goroutines so failing here leaks nothing
+	rateLimiter, err := createRateLimiter(opts.RateLimitAlgorithm, opts.Rate, opts.Tokens, opts.RateLimitStartEmpty, redisClient, "global")
+	if err != nil {
+		closeListeners(opts.Logger, listeners)
+		closeRedis(opts.Logger, redisClient)
+		return nil, err
+	}
+	ipLimiter := createPerIPLimiter(opts)
 
-	// Create rate limiter
-	rateLimiter := createRateLimiter(opts.Rate, opts.Tokens)
+	// Create worker pool
+	workerPool := createWorkerPool(opts, metrics, ipLimiter, ipFilter, routeLimiters, compress)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		WorkerPool: *workerPool,
+		WorkerPool: workerPool,
 		Port:       port,
 		URL:        url,
 		Opts:       opts,
 		Metrics:    metrics,
-		Listener:   listener,
+		Listener:   listeners[0],
+		Listeners:  listeners,
 		reqLimiter: rateLimiter,
+		ipLimiter:  ipLimiter,
+		ipFilter:   ipFilter,
+		logger:     opts.Logger,
+
+		redis: redisClient,
+
+		acceptLimiter: createAcceptLimiter(opts.AcceptRate),
+		tcpListeners:  tcpListeners,
+		listenAddrs:   addrs,
+
+		breaker: newOverloadBreaker(opts.Overload),
+		ipConns: make(map[string]int),
+
+		ctx:    ctx,
+		cancel: cancel,
 	}, nil
 }
 
-// Start starts the server and begins handling requests (blocks)
+// Start starts AcceptLoops accept loops on every listener (blocks until all the listeners are closed)
 func (s *Server) Start() {
-	log.Printf("Starting server on %s:%d", s.URL, s.Port)
-	handleRequests(s)
+	loops := max(s.Opts.AcceptLoops, 1)
+	s.logger.Info("starting server", "addr", s.Addr().String(), "listeners", len(s.Listeners), "accept_loops", loops)
+
+	// concurrent Accept calls on one listener are safe, the runtime hands each connection to one of them
+	var wg sync.WaitGroup
+	for _, listener := range s.Listeners {
+		for range loops {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handleRequests(s, listener)
+			}()
+		}
+	}
+	go s.sampleLimiters()
+	s.accepting.Store(true)
+	wg.Wait()
+}
+
+// how often the rate limiter gauges are updated
+const limiterSampleInterval = time.Second
+
+// sampleLimiters keeps the rate limiter gauges up to date until shutdown starts. Sampling
+// shows the buckets refilling between requests, which updating on each check would miss
+func (s *Server) sampleLimiters() {
+	ticker := time.NewTicker(limiterSampleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.closing.Load() {
+			return
+		}
+
+		s.limiterMutex.RLock()
+		limiter := s.reqLimiter
+		s.limiterMutex.RUnlock()
+		if counter, ok := limiter.(ratelimiter.TokenCounter); ok {
+			s.Metrics.LimiterTokens.Set(float64(counter.Available()))
+		}
+
+		if s.ipLimiter.Enabled() {
+			buckets, exhausted := s.ipLimiter.Stats()
+			s.Metrics.IPBuckets.Set(float64(buckets))
+			s.Metrics.IPBucketsExhausted.Set(float64(exhausted))
+		}
+
+		// keeps the breaker moving through its states while no connections come in
+		s.checkOverload()
+	}
+}
+
+// checkOverload feeds the current queue fill level to the overload breaker and reports
+// whether a new connection may be queued, and if not for how long the breaker stays open
+func (s *Server) checkOverload() (bool, time.Duration) {
+	if s.breaker == nil {
+		return true, 0
+	}
+	ok, state, retryAfter := s.breaker.allow(float64(len(s.JobChan)) / float64(cap(s.JobChan)))
+	s.Metrics.BreakerState.Set(float64(state))
+	return ok, retryAfter
+}
+
+// closeListeners closes every listener and logs the ones which fail
+func closeListeners(logger *slog.Logger, listeners []net.Listener) {
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil {
+			logger.Error("error closing listener", "addr", listener.Addr().String(), "err", err)
+		}
+	}
+}
+
+// Addr returns the address the main listener is bound to. With Port 0 this holds the port
+// the system picked, so tests and ephemeral instances can find the server
+func (s *Server) Addr() net.Addr {
+	return s.Listener.Addr()
+}
+
+// Ready reports whether the server is accepting connections, not shutting down and has all its workers
+func (s *Server) Ready() bool {
+	return s.accepting.Load() && !s.closing.Load() && !s.lameDuck.Load() && s.WorkerPool.Healthy()
+}
+
+// stopAccepting marks the server as closing and closes the listeners, only the first call does anything
+func (s *Server) stopAccepting() {
+	s.stopOnce.Do(func() {
+		s.closing.Store(true)
+		closeListeners(s.logger, s.Listeners)
+	})
+}
+
+// Drain stops accepting new connections and makes Ready report false, so load balancers
+// deregister the server before it shuts down. Connections already accepted are served,
+// kept alive ones are closed after their current request. Shutdown is still needed to
+// wait for them and stop the workers
+func (s *Server) Drain() {
+	s.logger.Info("draining, no longer accepting connections")
+	s.stopAccepting()
+	s.WorkerPool.draining.Store(true)
+}
+
+// Shutdown stops accepting new connections and waits for the jobs already in the
+// worker pool to drain before closing it. With PreShutdownDelay the server first keeps
+// serving that long while Ready reports false. Connections still open after DrainTimeout
+// are force closed. If ctx expires first an error is returned and the remaining
+// workers are left to finish in the background
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.waitLameDuck(ctx)
+	s.stopAccepting()
+	if s.ipLimiter != nil {
+		s.ipLimiter.Close()
+	}
+	done := s.closePool()
+	// route limits are checked until the last request is served
+	defer s.closeRedisAfter(done)
+
+	// a nil channel never fires, so without DrainTimeout only ctx bounds the wait
+	var drainExpired <-chan time.Time
+	if s.Opts.DrainTimeout > 0 {
+		drainTimer := time.NewTimer(s.Opts.DrainTimeout)
+		defer drainTimer.Stop()
+		drainExpired = drainTimer.C
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-drainExpired:
+		s.cancel()
+		closed := s.WorkerPool.ForceClose()
+		s.logger.Warn("drain timeout reached, force closed connections", "connections", closed)
+	case <-ctx.Done():
+		s.cancel()
+		return fmt.Errorf("shutdown: workers did not finish: %w", ctx.Err())
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown: workers did not finish: %w", ctx.Err())
+	}
+}
+
+// waitLameDuck fails readiness and keeps accepting for PreShutdownDelay, so load balancers
+// deregister the server while it still serves instead of their clients getting refused.
+// It returns early when ctx expires and does nothing once the server stopped accepting
+func (s *Server) waitLameDuck(ctx context.Context) {
+	if s.Opts.PreShutdownDelay <= 0 || s.closing.Load() {
+		return
+	}
+	s.lameDuck.Store(true)
+	s.logger.Info("failing readiness before shutting down", "delay", s.Opts.PreShutdownDelay)
+
+	timer := time.NewTimer(s.Opts.PreShutdownDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// closePool closes the worker pool in the background, the returned channel is closed once every worker exited
+func (s *Server) closePool() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.WorkerPool.Close()
+		close(done)
+	}()
+	return done
+}
+
+// closeRedisAfter closes the redis connections once done is closed. Workers still running
+// when the caller gives up keep their limiters, so the close then happens in the background
+func (s *Server) closeRedisAfter(done <-chan struct{}) {
+	if s.redis == nil {
+		return
+	}
+	select {
+	case <-done:
+		closeRedis(s.logger, s.redis)
+	default:
+		go func() {
+			<-done
+			closeRedis(s.logger, s.redis)
+		}()
+	}
+}
+
+// CloseWithTimeout stops accepting and lets the workers finish for up to d, then cancels the
+// job contexts and force closes the connections left. The error reports that workers didn't
+// finish in time, the workers still stuck are left to exit in the background so the caller
+// can always go on
+func (s *Server) CloseWithTimeout(d time.Duration) error {
+	s.stopAccepting()
+	if s.ipLimiter != nil {
+		s.ipLimiter.Close()
+	}
+	done := s.closePool()
+	defer s.closeRedisAfter(done)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+	}
+
+	s.cancel()
+	closed := s.WorkerPool.ForceClose()
+	return fmt.Errorf("close: workers did not finish within %s, force closed %d connections", d, closed)
 }
 
 // Close closes the socket listener and worker pool
 func (s *Server) Close() {
-	s.Listener.Close()
+	s.stopAccepting()
+	if s.ipLimiter != nil {
+		s.ipLimiter.Close()
+	}
+	// workers abort what they are doing instead of finishing their connections
+	s.cancel()
 	s.WorkerPool.Close()
+	closeRedis(s.logger, s.redis)
 }
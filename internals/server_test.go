@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atharvamhaske/tcpie/internals/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// startServer starts a server for cfg on a free port of 127.0.0.1, unless cfg sets its own URL,
+// and closes it when the test ends
+func startServer(t *testing.T, cfg Config, opts ...Option) *Server {
+	t.Helper()
+	if cfg.URL == "" {
+		cfg.URL = "127.0.0.1"
+	}
+	srv, err := New(cfg, append([]Option{WithLogger(slog.New(slog.DiscardHandler))}, opts...)...)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get sends a GET request for path on conn and reads the response with its body
+func get(t *testing.T, conn net.Conn, reader *bufio.Reader, path string) (*http.Response, string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	return readResponse(t, reader)
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+	return resp, string(body)
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		url  string
+		port int
+		want string
+	}{
+		{url: "localhost", port: 8080, want: "localhost:8080"},
+		{url: "127.0.0.1", port: 0, want: "127.0.0.1:0"},
+		{url: "", port: 8080, want: ":8080"},
+		{url: "::1", port: 8080, want: "[::1]:8080"},
+		{url: "[::1]", port: 8080, want: "[::1]:8080"},
+		{url: "::", port: 9000, want: "[::]:9000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := listenAddr(tt.url, tt.port); got != tt.want {
+				t.Errorf("listenAddr(%q, %d) = %q, want %q", tt.url, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeIPv6(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	probe.Close()
+
+	srv := startServer(t, Config{URL: "::1", Port: 0})
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing %s: %v", srv.Addr(), err)
+	}
+	defer conn.Close()
+
+	resp, body := get(t, conn, bufio.NewReader(conn), "/")
+	if resp.StatusCode != http.StatusOK || body != "Hello world !\n" {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, "Hello world !\n")
+	}
+}
+
+func TestEnqueueAfterClose(t *testing.T) {
+	tests := []struct {
+		name             string
+		queueFullTimeout time.Duration
+	}{
+		{name: "rejects immediately", queueFullTimeout: 0},
+		{name: "waits for a slot", queueFullTimeout: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := New(Config{URL: "127.0.0.1", ServerOpts: ServerOpts{MaxThreads: 1, QueueSize: 1, QueueFullTimeout: tt.queueFullTimeout}},
+				WithLogger(slog.New(slog.DiscardHandler)), WithMetrics(metrics.NewServerMetrics(nil)))
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			srv.Close()
+
+			// JobChan is closed by now, a send on it would panic
+			server, _ := connPair(t)
+			start := time.Now()
+			reason, ok := srv.enqueue(Job{Id: 1, Conn: server})
+			if ok || reason != "rejected_shutdown" {
+				t.Errorf("enqueue() = %q, %v, want %q, false", reason, ok, "rejected_shutdown")
+			}
+			if waited := time.Since(start); waited >= tt.queueFullTimeout && tt.queueFullTimeout > 0 {
+				t.Errorf("enqueue() waited %s for a slot of a closed pool", waited)
+			}
+		})
+	}
+}
+
+// clients connecting while the server shuts down are served, told it is shutting down or
+// disconnected, but never crash the accept loop with a send on the closed JobChan
+func TestAcceptDuringShutdown(t *testing.T) {
+	srv := startServer(t, Config{ServerOpts: ServerOpts{
+		MaxThreads: 2,
+		QueueSize:  4,
+		Handler: func(req *http.Request) (int, map[string]string, []byte) {
+			time.Sleep(5 * time.Millisecond)
+			return http.StatusOK, nil, []byte("ok")
+		},
+	}}, WithMetrics(metrics.NewServerMetrics(nil)))
+	addr := srv.Addr().String()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	statuses := make(chan int, 1024)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, err := net.DialTimeout("tcp", addr, time.Second)
+				if err != nil {
+					continue //refused once the listener is closed
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+				if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+					select {
+					case statuses <- resp.StatusCode:
+					default:
+					}
+				}
+				conn.Close()
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusOK && status != http.StatusServiceUnavailable {
+			t.Errorf("got status %d, want 200 or 503", status)
+		}
+	}
+}
+
+// registeredValue sums the series of the counter name with label set to value in the default registry
+func registeredValue(t *testing.T, name, label, value string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	var sum float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == label && l.GetValue() == value {
+					sum += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return sum
+}
+
+// every server New builds in a process records into the registered metrics, not only the first
+func TestNewServersShareMetrics(t *testing.T) {
+	before := registeredValue(t, "requests_completed_total", "status", "200")
+
+	servers := []*Server{startServer(t, Config{}), startServer(t, Config{})}
+	for i, srv := range servers {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		if err != nil {
+			t.Fatalf("dialing server %d: %v", i, err)
+		}
+		resp, _ := get(t, conn, bufio.NewReader(conn), "/")
+		conn.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("server %d answered %d, want 200", i, resp.StatusCode)
+		}
+	}
+
+	// the worker counts a response right after writing it
+	deadline := time.Now().Add(5 * time.Second)
+	for registeredValue(t, "requests_completed_total", "status", "200")-before < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := registeredValue(t, "requests_completed_total", "status", "200") - before; got != 2 {
+		t.Errorf("requests_completed_total{status=\"200\"} grew by %g, want 2, one per server", got)
+	}
+}
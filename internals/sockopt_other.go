@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// reusePortControl fails the listen, SO_REUSEPORT is not available on this platform
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
+
+// setListenBacklog fails, the backlog can't be changed after listen on this platform
+func setListenBacklog(l *net.TCPListener, backlog int) error {
+	return errors.New("listen_backlog is not supported on this platform")
+}
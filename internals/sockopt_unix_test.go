@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import (
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	tests := []struct {
+		name       string
+		reusePort  bool
+		secondBind bool
+	}{
+		{name: "on", reusePort: true, secondBind: true},
+		{name: "off", reusePort: false, secondBind: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := ServerOpts{Network: NetworkTCP, ReusePort: tt.reusePort}
+			first, _, err := createListener("127.0.0.1:0", opts, nil)
+			if err != nil {
+				t.Fatalf("first listener: %v", err)
+			}
+			defer first.Close()
+
+			second, _, err := createListener(first.Addr().String(), opts, nil)
+			if err == nil {
+				defer second.Close()
+			}
+			if got := err == nil; got != tt.secondBind {
+				t.Errorf("second listener on %s: err = %v, want it to bind: %v", first.Addr(), err, tt.secondBind)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"slices"
+	"strings"
+)
+
+// staticIndex is served for a request naming a directory
+const staticIndex = "index.html"
+
+// StaticHandler returns a handler serving the files under dir, the request path names the file
+// relative to dir and a directory serves its index.html. Paths with a .. element get 400, missing
+// files and paths leaving dir, also through a symlink, get 404. Files are read whole into memory
+// for every request, so it suits small sites and test fixtures rather than large downloads
+func StaticHandler(dir string) (Handler, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open static dir: %w", err)
+	}
+	fsys := root.FS()
+
+	return func(req *http.Request) (int, map[string]string, []byte) {
+		if slices.Contains(strings.Split(req.URL.Path, "/"), "..") {
+			return http.StatusBadRequest, nil, []byte("Bad Request\n")
+		}
+		name, body, err := readStatic(fsys, req.URL.Path)
+		if err != nil {
+			return http.StatusNotFound, nil, []byte("Not Found\n")
+		}
+
+		contentType := mime.TypeByExtension(pathpkg.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		return http.StatusOK, map[string]string{"Content-Type": contentType}, body
+	}, nil
+}
+
+// readStatic reads the file named by the request path from fsys, the index file for a
+// directory. It returns the name of the file read, whose extension tells its content type
+func readStatic(fsys fs.FS, urlPath string) (string, []byte, error) {
+	// fs.FS names are unrooted and must not end in a slash, "." is the root itself
+	name := strings.TrimPrefix(pathpkg.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if info.IsDir() {
+		return readStatic(fsys, pathpkg.Join(name, staticIndex))
+	}
+
+	body, err := io.ReadAll(f)
+	return name, body, err
+}
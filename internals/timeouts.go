@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaults of the Timeouts left at zero
+const (
+	defaultReadTimeout  = 3 * time.Second
+	defaultWriteTimeout = 2 * time.Second
+	defaultIdleTimeout  = 5 * time.Second
+)
+
+// rejectWriteTimeout bounds writing a response to a connection closed right after: the rejections
+// of rejectConn and dropOldest on the accept loop and the error responses of writeErrorResponse
+// in a worker. A client not reading, or stalling a TLS handshake, can't hold them up any longer
+const rejectWriteTimeout = time.Second
+
+// Timeouts are the deadlines of a connection and its requests. It is embedded in ServerOpts
+// and WorkerOpts, so the fields can be set on those directly
+type Timeouts struct {
+	ReadTimeout  time.Duration //reading a whole request, line, headers and body; 0 uses the default 3s
+	WriteTimeout time.Duration //writing a response; 0 uses the default 2s
+	IdleTimeout  time.Duration //waiting for the next request on a kept alive connection; 0 uses the default 5s
+
+	HandlerTimeout        time.Duration //budget for reading, handling and answering a request, expired ones get 503; 0 means no limit
+	MaxConnectionDuration time.Duration //lifetime cap of a connection however active it is; 0 means no limit
+}
+
+// DefaultTimeouts returns the timeouts the server uses for the fields left at zero
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		ReadTimeout:  defaultReadTimeout,
+		WriteTimeout: defaultWriteTimeout,
+		IdleTimeout:  defaultIdleTimeout,
+	}
+}
+
+// Validate reports a negative timeout, zero is fine for every field
+func (t Timeouts) Validate() error {
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ReadTimeout", t.ReadTimeout},
+		{"WriteTimeout", t.WriteTimeout},
+		{"IdleTimeout", t.IdleTimeout},
+		{"HandlerTimeout", t.HandlerTimeout},
+		{"MaxConnectionDuration", t.MaxConnectionDuration},
+	} {
+		if timeout.value < 0 {
+			return fmt.Errorf("%s must not be negative, got %s", timeout.name, timeout.value)
+		}
+	}
+	return nil
+}
+
+// withDefaults returns t with the zero fields which have a default set to it
+func (t Timeouts) withDefaults() Timeouts {
+	defaults := DefaultTimeouts()
+	if t.ReadTimeout <= 0 {
+		t.ReadTimeout = defaults.ReadTimeout
+	}
+	if t.WriteTimeout <= 0 {
+		t.WriteTimeout = defaults.WriteTimeout
+	}
+	if t.IdleTimeout <= 0 {
+		t.IdleTimeout = defaults.IdleTimeout
+	}
+	return t
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts Timeouts
+		wantErr  bool
+	}{
+		{name: "zero", timeouts: Timeouts{}},
+		{name: "defaults", timeouts: DefaultTimeouts()},
+		{name: "all set", timeouts: Timeouts{ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second, HandlerTimeout: time.Second, MaxConnectionDuration: time.Minute}},
+		{name: "negative read", timeouts: Timeouts{ReadTimeout: -time.Second}, wantErr: true},
+		{name: "negative write", timeouts: Timeouts{WriteTimeout: -time.Second}, wantErr: true},
+		{name: "negative idle", timeouts: Timeouts{IdleTimeout: -time.Second}, wantErr: true},
+		{name: "negative handler", timeouts: Timeouts{HandlerTimeout: -time.Second}, wantErr: true},
+		{name: "negative connection duration", timeouts: Timeouts{MaxConnectionDuration: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.timeouts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTimeoutsWithDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts Timeouts
+		want     Timeouts
+	}{
+		{name: "zero gets the defaults", timeouts: Timeouts{}, want: DefaultTimeouts()},
+		{
+			name:     "set fields are kept",
+			timeouts: Timeouts{ReadTimeout: time.Second, WriteTimeout: 4 * time.Second, IdleTimeout: time.Minute},
+			want:     Timeouts{ReadTimeout: time.Second, WriteTimeout: 4 * time.Second, IdleTimeout: time.Minute},
+		},
+		{
+			name:     "only unset fields get a default",
+			timeouts: Timeouts{ReadTimeout: time.Second},
+			want:     Timeouts{ReadTimeout: time.Second, WriteTimeout: defaultWriteTimeout, IdleTimeout: defaultIdleTimeout},
+		},
+		{
+			name:     "limits are kept",
+			timeouts: Timeouts{HandlerTimeout: time.Second, MaxConnectionDuration: time.Minute},
+			want:     Timeouts{ReadTimeout: defaultReadTimeout, WriteTimeout: defaultWriteTimeout, IdleTimeout: defaultIdleTimeout, HandlerTimeout: time.Second, MaxConnectionDuration: time.Minute},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.timeouts.withDefaults(); got != tt.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectionTimeouts(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	tests := []struct {
+		name       string
+		opts       WorkerOpts
+		send       string
+		wantStatus int //0 expects the connection closed without a response
+	}{
+		{name: "request not finished within ReadTimeout", opts: WorkerOpts{Timeouts: Timeouts{ReadTimeout: timeout}}, send: "GET / HTTP/1.1\r\nHost: te", wantStatus: http.StatusRequestTimeout},
+		{name: "body not finished within ReadTimeout", opts: WorkerOpts{Timeouts: Timeouts{ReadTimeout: timeout}}, send: "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nhel", wantStatus: http.StatusRequestTimeout},
+		{name: "no request within IdleTimeout", opts: WorkerOpts{KeepAlive: true, Timeouts: Timeouts{IdleTimeout: timeout}}, send: "GET / HTTP/1.1\r\nHost: test\r\n\r\n", wantStatus: http.StatusOK},
+		{name: "no PROXY header within ReadTimeout", opts: WorkerOpts{ProxyProtocol: true, Timeouts: Timeouts{ReadTimeout: timeout}}, send: "PROXY TCP4 192.168."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(t, 1, tt.opts)
+			server, client := connPair(t)
+			pool.SubmitJob(Job{Id: 1, Conn: server})
+
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(client, tt.send)
+			reader := bufio.NewReader(client)
+			if tt.wantStatus != 0 {
+				if resp, _ := readResponse(t, reader); resp.StatusCode != tt.wantStatus {
+					t.Errorf("got %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+			}
+
+			// then the connection is closed once the timeout passed, not held until the test deadline
+			start := time.Now()
+			if n, err := reader.Read(make([]byte, 1)); err == nil {
+				t.Fatalf("read %d more bytes, want the connection closed", n)
+			}
+			if waited := time.Since(start); waited > 2*time.Second {
+				t.Errorf("connection closed after %s, want about %s", waited, timeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Options configures the OTLP exporter spans are sent through
+type Options struct {
+	Endpoint    string  //host:port of the OTLP/HTTP collector
+	Insecure    bool    //plain HTTP instead of HTTPS
+	ServiceName string  //service.name of the spans
+	SampleRatio float64 //fraction of new traces sampled, requests with a sampled parent are always traced
+}
+
+// Provider creates the tracers of the server and flushes their spans on Shutdown
+type Provider struct {
+	provider *sdktrace.TracerProvider
+}
+
+// NewProvider sets up span export over OTLP/HTTP, spans are batched in the background
+func NewProvider(ctx context.Context, opts Options) (*Provider, error) {
+	exporterOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(opts.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	return &Provider{provider: provider}, nil
+}
+
+// Tracer returns the tracer used for request spans
+func (p *Provider) Tracer() trace.Tracer {
+	return p.provider.Tracer("github.com/atharvamhaske/tcpie")
+}
+
+// Shutdown exports the spans still buffered and stops the exporter
+func (p *Provider) Shutdown(ctx context.Context) error {
+	return p.provider.Shutdown(ctx)
+}
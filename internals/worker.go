@@ -1,90 +1,1168 @@
 package server
 
 import (
-	"log"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/atharvamhaske/tcpie/internals/metrics"
+	ratelimiter "github.com/atharvamhaske/tcpie/internals/rate-limiter"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultReadBufferSize  = 4096
+	defaultMaxRequestBytes = 1 << 20 // 1MB
+	defaultMaxHeaderBytes  = 1 << 20 // 1MB, like net/http
+)
+
+// outcomes used to label per request metrics
+const (
+	outcomeOK      = "ok"
+	outcomeTimeout = "timeout"
+	outcomeError   = "error"
+	outcomeClosed  = "closed" //the client disconnected before sending a whole request
+	outcomeReset   = "reset"  //the connection was reset on purpose by ResetRate
 )
 
+// label used for methods and paths outside the known set
+const labelOther = "other"
+
+// methods labeled as is, anything else a client sends is bucketed into "other"
+var knownMethods = map[string]struct{}{
+	http.MethodGet:     {},
+	http.MethodHead:    {},
+	http.MethodPost:    {},
+	http.MethodPut:     {},
+	http.MethodPatch:   {},
+	http.MethodDelete:  {},
+	http.MethodConnect: {},
+	http.MethodOptions: {},
+	http.MethodTrace:   {},
+}
+
+var errRequestTooLarge = errors.New("request body exceeds max request bytes")
+
+var errBadBody = errors.New("malformed request body")
+
+var errExpectationFailed = errors.New("expectation in the Expect header can't be met")
+
+var errHeaderTooLarge = errors.New("request headers exceed max header bytes")
+
+var errSlowClient = errors.New("request arrives slower than min read rate")
+
 // Job is a task submitted by server to the worker pool
 type Job struct {
-	Id   int
-	Conn net.Conn
+	Id       int
+	Conn     net.Conn
+	Accepted time.Time //when the connection was accepted, zero means when a worker picks it up
+	Enqueued time.Time //when the job was put on JobChan, zero leaves it out of the queue wait metric
+
+	// cancelled when the server gives up on its connections, nil means context.Background().
+	// Every request context of the connection derives from it
+	Ctx context.Context
+}
+
+// WorkerOpts are the settings workers use while serving a connection
+type WorkerOpts struct {
+	ReadBufferSize  int //size of each read from the connection
+	MaxRequestBytes int //request bodies bigger than this are rejected with 413
+	MaxHeaderBytes  int //request line and headers bigger than this are rejected with 431
+	Handler         Handler
+	KeepAlive       bool //serve more than one request per connection
+	Metrics         metrics.ServerMetrics
+	Logger          *slog.Logger //defaults to slog.Default()
+	LogSampleRate   int          //log the per request debug lines of 1 in N jobs, 0 or 1 logs all
+
+	// deadlines of each connection and request, the zero ones with a default get it
+	Timeouts
+	ProxyProtocol bool         //every connection must start with a PROXY protocol v1 or v2 header
+	MetricPaths   []string     //paths labeled as is on the requests metric, others are bucketed into "other"
+	Tracer        trace.Tracer //creates a span for every request, nil disables tracing
+
+	WorkerIdleTimeout time.Duration //workers without a job for this long exit, 0 keeps every worker running
+	MinWorkers        int           //workers kept running when idle ones exit, defaults to 1
+
+	// per ip limiter checked once the PROXY header gave the real client address,
+	// only set with ProxyProtocol since the accept loop only sees the balancer
+	IPLimiter       *ratelimiter.PerIPLimiter
+	IPLimitResponse RejectResponse //sent when IPLimiter rejects a client, RetryAfter is used as is
+	IPFilter        *IPFilter      //clients it doesn't allow are disconnected without a response
+
+	RouteLimiters []RouteLimiter //the first one matching the request path is checked, unmatched requests pass
+
+	ResponseDelay       time.Duration //added before every response, bounded by HandlerTimeout
+	ResponseDelayJitter time.Duration //random extra delay between 0 and this
+
+	MaxWorkersPerCPU int //clamps the worker count to this many per cpu, 0 only warns about suspicious counts
+
+	// wrapped around Handler in order, inside the built in request counting and route limits
+	Middleware []Middleware
+
+	AccessLog *AccessLog //gets a line for every request answered after it was read, nil disables it
+
+	ServerHeader string //value of the Server header on every response, empty leaves it out
+
+	ResetRate            float64 //fraction of responses ending in a connection reset, for testing clients
+	ResetWithoutResponse bool    //reset before writing the response instead of right after it
+
+	RequestIDHeader string //header with the id of each request, kept from the client or generated; empty disables ids
+
+	// clients sending a request slower than MinReadRate bytes per second are answered with 408
+	// and disconnected, judged once MinReadRateGrace passed. 0 disables the check
+	MinReadRate      int
+	MinReadRateGrace time.Duration
+}
+
+// RouteLimiter rate limits the requests whose path matches Pattern
+type RouteLimiter struct {
+	Pattern  string
+	Limiter  ratelimiter.Limiter
+	Response RejectResponse //sent when Limiter rejects a request, RetryAfter is used as is
 }
 
 type WorkerPool struct {
 	MaxWorkers int      //max no of workers worker pool can handle concurrently
 	QueueSize  int      //number of task that will kept in queue if all the workers are busy
 	JobChan    chan Job //buffered channel used to put job in worker pool
+	opts       WorkerOpts
 	wg         *sync.WaitGroup
+	mutex      sync.Mutex    //guards MaxWorkers, live, nextId and closed
+	live       int           //running workers, below MaxWorkers while idle workers have exited
+	idle       atomic.Int64  //workers waiting for a job right now
+	alive      atomic.Int64  //worker goroutines running, unlike live it only drops once one returned
+	inFlight   atomic.Int64  //jobs taken off the queue and being served right now
+	quit       chan struct{} //each receive tells one worker to exit, used when shrinking
+	nextId     int
+	closed     bool
+	logCount   atomic.Uint64 //jobs seen by sampleLog
+	draining   atomic.Bool   //set by Close, kept alive connections are closed after their current request
+	knownPaths map[string]struct{}
+	handler    Handler //opts.Handler wrapped in the middleware
+
+	// closed by Close, senders select on it next to JobChan and give up instead of sending.
+	// They hold sendMutex for reading while they send, so JobChan is only closed once none is left
+	done      chan struct{}
+	sendMutex sync.RWMutex
+
+	connMutex   sync.Mutex            //guards activeConns and forced
+	activeConns map[net.Conn]struct{} //connections workers are serving right now
+	forced      bool                  //set by ForceClose, jobs left in the queue are closed without being served
 }
 
-func NewWorkerPool(maxWorkers, queueSize int) *WorkerPool {
+func NewWorkerPool(maxWorkers, queueSize int, opts WorkerOpts) *WorkerPool {
+	if opts.ReadBufferSize <= 0 {
+		opts.ReadBufferSize = defaultReadBufferSize
+	}
+	if opts.MaxRequestBytes <= 0 {
+		opts.MaxRequestBytes = defaultMaxRequestBytes
+	}
+	if opts.MaxHeaderBytes <= 0 {
+		opts.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if opts.Handler == nil {
+		opts.Handler = helloHandler
+	}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.MinWorkers <= 0 {
+		opts.MinWorkers = 1
+	}
+	maxWorkers = opts.limitWorkers(maxWorkers)
+
 	w := &WorkerPool{
 		MaxWorkers: maxWorkers,
 		QueueSize:  queueSize,
 		JobChan:    make(chan Job, maxWorkers+queueSize), // Channel size = MaxWorkers + QueueSize
+		opts:       opts,
 		wg:         new(sync.WaitGroup),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+
+		activeConns: make(map[net.Conn]struct{}),
+		knownPaths:  make(map[string]struct{}, len(opts.MetricPaths)),
 	}
-	for i := 0; i < w.MaxWorkers; i++ {
-		w.wg.Add(1)
-		go w.worker(i)
+	for _, path := range opts.MetricPaths {
+		w.knownPaths[path] = struct{}{}
 	}
+	w.handler = chain(opts.Handler, append([]Middleware{w.countRequests, w.limitRoutes}, opts.Middleware...))
+	w.spawn(w.MaxWorkers)
 	return w
 }
 
+// worker counts above this many per cpu are logged as a likely typo, requests are I/O bound
+// so far more workers than cpus is normal
+const workersPerCPUWarning = 256
+
+// limitWorkers clamps n to MaxWorkersPerCPU per cpu when that is set, otherwise it only warns
+// when n is suspiciously high. Either way it is advisory, nothing fails
+func (opts WorkerOpts) limitWorkers(n int) int {
+	cpus := runtime.NumCPU()
+	if opts.MaxWorkersPerCPU > 0 && n > cpus*opts.MaxWorkersPerCPU {
+		opts.Logger.Warn("worker count clamped", "workers", n, "cpus", cpus, "max_workers_per_cpu", opts.MaxWorkersPerCPU)
+		return cpus * opts.MaxWorkersPerCPU
+	}
+	if n > cpus*workersPerCPUWarning {
+		opts.Logger.Warn("worker count is far above the number of cpus, check it isn't a typo", "workers", n, "cpus", cpus)
+	}
+	return n
+}
+
+// spawn starts n more workers, callers must hold the mutex (or own the pool exclusively)
+func (w *WorkerPool) spawn(n int) {
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		w.alive.Add(1)
+		go w.worker(w.nextId)
+		w.nextId++
+	}
+	w.live += n
+}
+
+// grow starts another worker when jobs are waiting and idle workers have exited,
+// it is called after a job is queued and does nothing without WorkerIdleTimeout
+func (w *WorkerPool) grow() {
+	if w.opts.WorkerIdleTimeout <= 0 || int64(len(w.JobChan)) <= w.idle.Load() {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.closed && w.live < w.MaxWorkers {
+		w.spawn(1)
+	}
+}
+
+// retire reports whether an idle worker may exit, which it may while more than MinWorkers are running
+func (w *WorkerPool) retire() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed || w.live <= w.opts.MinWorkers {
+		return false
+	}
+	w.live--
+	return true
+}
+
 // worker is a thread which processes the requests, ye jab tak maxworkers hai tab tak
 // usko wo job execute krne dete hai
 func (w *WorkerPool) worker(workerId int) {
-	processRequests := func(j Job) {
-		// Set read deadline to prevent hanging (3 seconds)
-		j.Conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer w.wg.Done()
+	defer w.alive.Add(-1)
 
-		request := make([]byte, 4096)
-		_, err := j.Conn.Read(request)
-		if err != nil {
-			// Timeout or read error - send error response before closing
-			j.Conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
-			errorResponse := []byte("HTTP/1.1 408 Request Timeout\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
-			j.Conn.Write(errorResponse)
-			j.Conn.Close()
+	// a nil channel never fires, so without WorkerIdleTimeout workers never go idle
+	var idleTimer *time.Timer
+	var idleExpired <-chan time.Time
+	if w.opts.WorkerIdleTimeout > 0 {
+		idleTimer = time.NewTimer(w.opts.WorkerIdleTimeout)
+		defer idleTimer.Stop()
+		idleExpired = idleTimer.C
+	}
+
+	for {
+		if idleTimer != nil {
+			idleTimer.Reset(w.opts.WorkerIdleTimeout)
+		}
+
+		w.idle.Add(1)
+		select {
+		case job, ok := <-w.JobChan:
+			w.idle.Add(-1)
+			if !ok {
+				return
+			}
+			w.opts.Metrics.QueueDepth.Set(float64(len(w.JobChan)))
+			if !job.Enqueued.IsZero() {
+				w.opts.Metrics.QueueWait.Observe(time.Since(job.Enqueued).Seconds())
+			}
+
+			w.inFlight.Add(1)
+			w.opts.Metrics.InFlight.Inc()
+			w.serveJob(workerId, job)
+			w.inFlight.Add(-1)
+			w.opts.Metrics.InFlight.Dec()
+			w.opts.Metrics.JobsCompleted.Inc()
+		case <-w.quit:
+			w.idle.Add(-1)
+			w.opts.Logger.Info("worker exiting after resize", "worker_id", workerId)
 			return
+		case <-idleExpired:
+			w.idle.Add(-1)
+			if w.retire() {
+				w.opts.Logger.Debug("worker exiting after idle timeout", "worker_id", workerId)
+				return
+			}
 		}
+	}
+}
 
-		// Set write deadline before sending response
-		j.Conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+// Alive returns the number of worker goroutines running right now
+func (w *WorkerPool) Alive() int {
+	return int(w.alive.Load())
+}
 
-		// Send proper HTTP response with Connection: close header
-		// Content-Length must match actual body length (14 bytes: "Hello world !\n")
-		response := []byte("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 14\r\n\r\nHello world !\n")
-		bytesWritten, writeErr := j.Conn.Write(response)
-		if writeErr != nil || bytesWritten != len(response) {
-			// Write failed or incomplete, close and return
-			j.Conn.Close()
+// Healthy reports whether the pool is open and every worker it expects is still running. A
+// worker exiting without being retired or stopped by Resize makes it false, that capacity
+// is silently gone otherwise
+func (w *WorkerPool) Healthy() bool {
+	// read under the mutex, a retiring worker is uncounted from live before it returns
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return !w.closed && w.Alive() >= w.live
+}
+
+// InFlight returns the number of jobs workers are serving right now, jobs still in the queue are not counted
+func (w *WorkerPool) InFlight() int64 {
+	return w.inFlight.Load()
+}
+
+// serveJob processes one job. A panic is recovered here so the worker survives it and
+// the pool doesn't silently lose capacity
+func (w *WorkerPool) serveJob(workerId int, j Job) {
+	if j.Accepted.IsZero() {
+		j.Accepted = time.Now()
+	}
+	// deferred first so it runs last, after the connection is closed on every path
+	defer func() {
+		w.opts.Metrics.ConnectionDuration.Observe(time.Since(j.Accepted).Seconds())
+	}()
+
+	j.Conn = &countingConn{Conn: j.Conn, metrics: w.opts.Metrics}
+
+	if w.opts.ProxyProtocol {
+		conn, ok := w.acceptProxy(j)
+		if !ok {
 			return
 		}
+		j.Conn = conn
+	}
+
+	// per request lines are debug only and sampled, the logger isn't even built when they are skipped
+	var reqLogger *slog.Logger
+	if w.opts.Logger.Enabled(context.Background(), slog.LevelDebug) && w.sampleLog() {
+		reqLogger = w.opts.Logger.With("worker_id", workerId, "conn_id", j.Id, "remote_addr", j.Conn.RemoteAddr().String())
+		reqLogger.Debug("processing request")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			w.opts.Logger.Error("recovered panic while processing request", "worker_id", workerId, "conn_id", j.Id,
+				"remote_addr", j.Conn.RemoteAddr().String(), "panic", r, "stack", string(debug.Stack()))
+			w.opts.Metrics.Panics.Inc()
+			j.Conn.Close()
+		}
+	}()
+
+	w.serveConn(j, reqLogger)
+}
 
-		// Close connection - TCP default behavior will send all pending data
-		// before closing, ensuring curl receives the complete response
+// acceptProxy reads the PROXY header of the job connection and applies the ip filter and the per
+// ip limit to the client it names. Connections without a valid header, from a client that isn't
+// allowed or over the limit are closed here
+func (w *WorkerPool) acceptProxy(j Job) (net.Conn, bool) {
+	j.Conn.SetReadDeadline(time.Now().Add(w.opts.ReadTimeout))
+	conn, err := readProxyHeader(j.Conn)
+	if err != nil {
+		w.opts.Metrics.ActiveConnections.Dec()
+		w.opts.Metrics.Requests.WithLabelValues("rejected_proxy_header").Inc()
+		w.opts.Metrics.Rejections.WithLabelValues(reasonBadProxy).Inc()
 		j.Conn.Close()
+		w.opts.Logger.Warn("request rejected", "conn_id", j.Id, "remote_addr", j.Conn.RemoteAddr().String(), "reason", reasonBadProxy, "err", err)
+		return nil, false
+	}
+
+	if w.opts.IPFilter.Enabled() && !w.opts.IPFilter.Allowed(clientIP(conn)) {
+		w.opts.Metrics.ActiveConnections.Dec()
+		w.opts.Metrics.Requests.WithLabelValues("rejected_ip_denied").Inc()
+		w.opts.Metrics.Rejections.WithLabelValues(reasonIPDenied).Inc()
+		conn.Close()
+		w.opts.Logger.Warn("request rejected", "conn_id", j.Id, "remote_addr", conn.RemoteAddr().String(), "reason", reasonIPDenied)
+		return nil, false
+	}
+
+	if w.opts.IPLimiter.Enabled() && !w.opts.IPLimiter.Allow(clientIP(conn)) {
+		w.opts.Metrics.ActiveConnections.Dec()
+		w.opts.Metrics.Requests.WithLabelValues("rejected_rate_limit").Inc()
+		w.opts.Metrics.Rejections.WithLabelValues(reasonPerIPLimit).Inc()
+		conn.SetWriteDeadline(time.Now().Add(w.opts.WriteTimeout))
+		conn.Write(w.reject(w.opts.IPLimitResponse, w.opts.IPLimitResponse.RetryAfter))
+		w.recordStatus(w.opts.IPLimitResponse.Status)
+		conn.Close()
+		w.opts.Logger.Warn("request rejected", "conn_id", j.Id, "remote_addr", conn.RemoteAddr().String(), "reason", reasonPerIPLimit)
+		return nil, false
+	}
+	return conn, true
+}
+
+// sampleLog reports whether the per request lines of a job should be logged, 1 in LogSampleRate jobs is
+func (w *WorkerPool) sampleLog() bool {
+	if w.opts.LogSampleRate <= 1 {
+		return true
+	}
+	return w.logCount.Add(1)%uint64(w.opts.LogSampleRate) == 0
+}
+
+// serveConn serves requests on the connection until it has to be closed, which is right
+// after the first response unless keep-alive is enabled and the client asked for it.
+// logger is nil when per request lines are not logged for this job
+func (w *WorkerPool) serveConn(j Job, logger *slog.Logger) {
+	// deferred so the gauge stays correct on every return path, including panics
+	defer w.opts.Metrics.ActiveConnections.Dec()
+	defer j.Conn.Close()
+
+	if !w.trackConn(j.Conn) {
+		return
+	}
+	defer w.untrackConn(j.Conn)
+
+	// bounds every deadline of the connection, so a slow client can't hold it past MaxConnectionDuration
+	connCtx, cancel := w.connContext(j.Ctx)
+	defer cancel()
+	// a read or write blocked when the context ends fails right away instead of at its deadline
+	stopAbort := context.AfterFunc(connCtx, func() { j.Conn.SetDeadline(time.Now()) })
+	defer stopAbort()
+
+	// one reader for the whole connection: pipelined requests arrive in the same reads, so bytes
+	// buffered past the end of a request belong to the next one and must not be dropped. Nothing
+	// may read from j.Conn directly while the reader is in use. The limits sit below the reader
+	// so a client can't make it buffer headers without end or drip feed them
+	limit := &requestLimitReader{r: j.Conn, n: noHeaderLimit, minRate: w.opts.MinReadRate, grace: w.opts.MinReadRateGrace}
+	reader := bufio.NewReaderSize(limit, w.opts.ReadBufferSize)
+	for first := true; ; first = false {
+		if connCtx.Err() != nil {
+			// the connection reached MaxConnectionDuration or the server is stopping
+			if logger != nil {
+				logger.Debug("closing connection, its context is done", "err", connCtx.Err())
+			}
+			return
+		}
+		if !first && !w.waitForRequest(connCtx, j.Conn, reader) {
+			return
+		}
+
+		start := time.Now()
+		outcome, keepAlive, requestID := w.processRequest(connCtx, j.Conn, reader, limit)
+		w.opts.Metrics.Latency.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+		if logger != nil {
+			logger.Debug("request served", "outcome", outcome, "keep_alive", keepAlive, "request_id", requestID)
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// trackConn registers conn as being served so ForceClose can reach it,
+// it returns false when ForceClose already ran and conn must not be served
+func (w *WorkerPool) trackConn(conn net.Conn) bool {
+	w.connMutex.Lock()
+	defer w.connMutex.Unlock()
+
+	if w.forced {
+		return false
+	}
+	w.activeConns[conn] = struct{}{}
+	return true
+}
+
+func (w *WorkerPool) untrackConn(conn net.Conn) {
+	w.connMutex.Lock()
+	delete(w.activeConns, conn)
+	w.connMutex.Unlock()
+}
+
+// ForceClose closes every connection the workers are still serving and makes them close
+// the jobs left in the queue without serving them. It returns how many connections were cut
+func (w *WorkerPool) ForceClose() int {
+	w.connMutex.Lock()
+	defer w.connMutex.Unlock()
+
+	w.forced = true
+	for conn := range w.activeConns {
+		conn.Close()
 	}
+	return len(w.activeConns)
+}
+
+// waitForRequest waits up to IdleTimeout for the next request on a kept alive connection,
+// an idle client is just disconnected without any response
+func (w *WorkerPool) waitForRequest(connCtx context.Context, conn net.Conn, reader *bufio.Reader) bool {
+	conn.SetReadDeadline(deadlineWithin(connCtx, w.opts.IdleTimeout))
+	_, err := reader.Peek(1)
+	return err == nil
+}
+
+// processRequest reads one request, runs the handler and writes the response. It returns
+// the outcome used to label metrics, whether the connection can serve another request and
+// the request id, empty when ids are disabled or no request could be read
+func (w *WorkerPool) processRequest(connCtx context.Context, conn net.Conn, reader *bufio.Reader, limit *requestLimitReader) (string, bool, string) {
+	// HandlerTimeout is the budget for the whole request, read and write deadlines never go past it
+	ctx, cancel := w.requestContext(connCtx)
+	defer cancel()
+
+	// Set read deadline to prevent hanging, it covers reading the whole request
+	conn.SetReadDeadline(deadlineWithin(ctx, w.opts.ReadTimeout))
 
-	for job := range w.JobChan {
-		log.Printf("Worker %d, processing request %d", workerId, job.Id)
-		processRequests(job)
+	start := time.Now()
+	req, err := w.readRequest(conn, reader, limit)
+	if err != nil {
+		status := readErrorStatus(err)
+		switch {
+		case errors.Is(err, io.EOF):
+			// closed between requests, there is nobody left to answer
+			return outcomeClosed, false, ""
+		case status == 0:
+			// reset or closed halfway through the request, a response would go to a dead socket
+			w.opts.Logger.Warn("reading request failed", "remote_addr", conn.RemoteAddr().String(), "err", err)
+			return outcomeError, false, ""
+		}
+		if errors.Is(err, errSlowClient) {
+			w.opts.Metrics.SlowClients.Inc()
+			w.opts.Logger.Warn("evicting slow client", "remote_addr", conn.RemoteAddr().String(), "min_read_rate", w.opts.MinReadRate)
+		}
+		w.writeErrorResponse(conn, status, nil)
+		w.recordStatus(status)
+		if status == http.StatusRequestTimeout {
+			return outcomeTimeout, false, ""
+		}
+		return outcomeError, false, ""
 	}
 
-	w.wg.Done()
+	// set on req so the handler and the access log see it, every response below carries it back
+	requestID := w.requestID(req)
+
+	// the span needs the request headers, so it starts once the request is read but is timed from start
+	var span trace.Span
+	if w.opts.Tracer != nil {
+		ctx, span = w.startSpan(ctx, conn, req, start)
+		defer span.End()
+	}
+
+	stopWatch := watchDisconnect(conn, reader, cancel)
+	status, headers, body, err := w.runHandler(ctx, req)
+	if err == nil {
+		err = w.delayResponse(ctx)
+	}
+	stopWatch()
+	if err != nil {
+		// handler ran out of time or the client went away
+		w.writeErrorResponse(conn, http.StatusServiceUnavailable, w.withRequestID(nil, requestID))
+		w.recordStatus(http.StatusServiceUnavailable)
+		w.logAccess(conn, req, http.StatusServiceUnavailable, 0, start)
+		if span != nil {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(http.StatusServiceUnavailable))
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return outcomeTimeout, false, requestID
+	}
+
+	// req.Close covers both "Connection: close" and HTTP/1.0 clients that didn't ask for keep-alive,
+	// while draining the connection is closed after this response
+	keepAlive := w.opts.KeepAlive && !req.Close && !w.draining.Load()
+
+	// Set write deadline before sending response
+	conn.SetWriteDeadline(deadlineWithin(ctx, w.opts.WriteTimeout))
+
+	// a HEAD response has the headers of the GET one, the client reads no body after them
+	respond, sent := w.response, len(body)
+	if req.Method == http.MethodHead {
+		respond = w.headResponse
+	}
+	if req.Method == http.MethodHead || !statusHasBody(status) {
+		sent = 0
+	}
+	response := respond(status, w.withRequestID(headers, requestID), body, keepAlive)
+	if w.opts.ResetRate > 0 && rand.Float64() < w.opts.ResetRate {
+		// fault injection, the client sees the connection reset like a crashed backend
+		if !w.opts.ResetWithoutResponse {
+			writeFull(conn, response)
+		}
+		resetConn(conn)
+		return outcomeReset, false, requestID
+	}
+	if err := writeFull(conn, response); err != nil {
+		// Write failed or the deadline passed mid response, the connection can't be reused
+		if span != nil {
+			span.SetStatus(codes.Error, "response write failed")
+		}
+		return outcomeError, false, requestID
+	}
+	w.recordStatus(status)
+	w.logAccess(conn, req, status, sent, start)
+	if span != nil {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+
+	// When the connection is closed TCP default behavior will send all pending data
+	// before closing, ensuring curl receives the complete response
+	return outcomeOK, keepAlive, requestID
+}
+
+// logAccess writes the access log line of req when there is an access log
+func (w *WorkerPool) logAccess(conn net.Conn, req *http.Request, status, bytes int, start time.Time) {
+	if w.opts.AccessLog == nil {
+		return
+	}
+	w.opts.AccessLog.log(accessEntry{
+		remoteAddr: conn.RemoteAddr(),
+		req:        req,
+		status:     status,
+		bytes:      bytes,
+		start:      start,
+		duration:   time.Since(start),
+	})
+}
+
+// startSpan starts the server span of req, continuing the trace of its traceparent header when there is one
+func (w *WorkerPool) startSpan(ctx context.Context, conn net.Conn, req *http.Request, start time.Time) (context.Context, trace.Span) {
+	ctx = propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(req.Header))
+
+	method, path := w.routeLabels(req)
+	return w.opts.Tracer.Start(ctx, method+" "+path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLPath(req.URL.Path),
+			semconv.ClientAddress(conn.RemoteAddr().String()),
+		),
+	)
 }
 
-// SubmitJob puts the job into the channel and idle worker picks up
+// countRequests is the middleware counting every parsed request by method and path
+func (w *WorkerPool) countRequests(next Handler) Handler {
+	return func(req *http.Request) (int, map[string]string, []byte) {
+		w.opts.Metrics.HTTPRequests.WithLabelValues(w.routeLabels(req)).Inc()
+		return next(req)
+	}
+}
+
+// limitRoutes is the middleware answering requests over the limit of their route with its reject response
+func (w *WorkerPool) limitRoutes(next Handler) Handler {
+	if len(w.opts.RouteLimiters) == 0 {
+		return next
+	}
+	return func(req *http.Request) (int, map[string]string, []byte) {
+		if route := w.matchRoute(req.URL.Path); route != nil && !route.Limiter.Allow() {
+			return route.Response.Status, route.Response.headers(route.Response.RetryAfter), []byte(route.Response.Body)
+		}
+		return next(req)
+	}
+}
+
+// matchRoute returns the first route limiter whose pattern matches path, nil when none does
+func (w *WorkerPool) matchRoute(path string) *RouteLimiter {
+	for i := range w.opts.RouteLimiters {
+		// patterns were checked when the server was created, a match error can't happen here
+		if ok, _ := pathpkg.Match(w.opts.RouteLimiters[i].Pattern, path); ok {
+			return &w.opts.RouteLimiters[i]
+		}
+	}
+	return nil
+}
+
+// recordStatus counts a response written by a worker under its status code
+func (w *WorkerPool) recordStatus(status int) {
+	w.opts.Metrics.Completed.WithLabelValues(strconv.Itoa(status)).Inc()
+}
+
+// routeLabels returns the method and path labels of req, both are client controlled
+// so values outside the known sets are reported as "other"
+func (w *WorkerPool) routeLabels(req *http.Request) (string, string) {
+	method, path := req.Method, req.URL.Path
+	if _, ok := knownMethods[method]; !ok {
+		method = labelOther
+	}
+	if _, ok := w.knownPaths[path]; !ok {
+		path = labelOther
+	}
+	return method, path
+}
+
+// delayResponse waits ResponseDelay plus a random jitter before the response is written,
+// it returns early with the context error when the handler timeout expires or the client goes away
+func (w *WorkerPool) delayResponse(ctx context.Context) error {
+	delay := w.opts.ResponseDelay
+	if w.opts.ResponseDelayJitter > 0 {
+		delay += rand.N(w.opts.ResponseDelayJitter + 1)
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// requestContext returns the context handed to the handler, bounded by HandlerTimeout when set and by connCtx
+func (w *WorkerPool) requestContext(connCtx context.Context) (context.Context, context.CancelFunc) {
+	if w.opts.HandlerTimeout > 0 {
+		return context.WithTimeout(connCtx, w.opts.HandlerTimeout)
+	}
+	return context.WithCancel(connCtx)
+}
+
+// connContext returns the context every request of a connection derives from, it is
+// derived from the job context and expires after MaxConnectionDuration when set
+func (w *WorkerPool) connContext(jobCtx context.Context) (context.Context, context.CancelFunc) {
+	if jobCtx == nil {
+		jobCtx = context.Background()
+	}
+	if w.opts.MaxConnectionDuration > 0 {
+		return context.WithTimeout(jobCtx, w.opts.MaxConnectionDuration)
+	}
+	return context.WithCancel(jobCtx)
+}
+
+// deadlineWithin returns now+d, or the deadline of ctx when that comes first
+func deadlineWithin(ctx context.Context, d time.Duration) time.Time {
+	t := time.Now().Add(d)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(t) {
+		return ctxDeadline
+	}
+	return t
+}
+
+// runHandler calls the handler with ctx attached to the request and gives up as soon as
+// ctx is done, the handler is expected to watch req.Context() and stop its own work
+func (w *WorkerPool) runHandler(ctx context.Context, req *http.Request) (int, map[string]string, []byte, error) {
+	type result struct {
+		status  int
+		headers map[string]string
+		body    []byte
+	}
+
+	// buffered so a late handler doesn't leak blocked on send
+	done := make(chan result, 1)
+	panics := make(chan any, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panics <- r
+			}
+		}()
+		status, headers, body := w.handler(req.WithContext(ctx))
+		done <- result{status, headers, body}
+	}()
+
+	select {
+	case r := <-done:
+		return r.status, r.headers, r.body, nil
+	case r := <-panics:
+		// raised again on the worker goroutine so serveJob recovers it like any other panic
+		panic(r)
+	case <-ctx.Done():
+		return 0, nil, nil, ctx.Err()
+	}
+}
+
+// countingConn adds what is read from and written to the connection to the byte counters
+type countingConn struct {
+	net.Conn
+	metrics metrics.ServerMetrics
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.BytesRead.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.BytesWritten.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// resetConn closes conn with SO_LINGER 0, which makes the kernel send RST instead of FIN.
+// Connections wrapping the socket are unwrapped through NetConn like tls.Conn allows
+func resetConn(conn net.Conn) {
+	for inner := conn; ; {
+		if tcpConn, ok := inner.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+			break
+		}
+		wrapper, ok := inner.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		inner = wrapper.NetConn()
+	}
+	conn.Close()
+}
+
+// watchDisconnect cancels the request context if the client closes the connection while
+// the handler runs. It peeks through reader so bytes of a pipelined request stay buffered
+// for the next read. The returned func stops watching and must be called before reader is used again
+func watchDisconnect(conn net.Conn, reader *bufio.Reader, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	conn.SetReadDeadline(time.Time{})
+
+	go func() {
+		defer close(done)
+		_, err := reader.Peek(1)
+
+		// a timeout here is the stop func unblocking the read, anything else means the client is gone
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			cancel()
+		}
+	}()
+
+	return func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+	}
+}
+
+// readRequest parses a full HTTP request from the connection regardless of how it was
+// segmented, the body is read upfront so it can be checked against MaxRequestBytes.
+// Request line and headers may take up to MaxHeaderBytes and the whole request must arrive at
+// MinReadRate, both enforced by limit
+func (w *WorkerPool) readRequest(conn net.Conn, reader *bufio.Reader, limit *requestLimitReader) (*http.Request, error) {
+	limit.startRate(time.Now())
+	defer limit.stopRate()
+
+	// bytes already buffered were read past the previous request, they count against this one.
+	// Like net/http the limit gets a buffer's worth of slack so a request just under it isn't cut
+	limit.n = int64(w.opts.MaxHeaderBytes+w.opts.ReadBufferSize) - int64(reader.Buffered())
+	req, err := http.ReadRequest(reader)
+	headerLimitHit := limit.n <= 0
+	limit.n = noHeaderLimit
+	if err != nil {
+		// http.ReadRequest doesn't wrap read errors, it may report the truncated request instead
+		switch {
+		case limit.slow:
+			return nil, errSlowClient
+		case headerLimitHit:
+			return nil, errHeaderTooLarge
+		}
+		return nil, err
+	}
+	if err := w.handleExpect(conn, req); err != nil {
+		return nil, err
+	}
+	if req.ContentLength > int64(w.opts.MaxRequestBytes) {
+		return nil, errRequestTooLarge
+	}
+
+	// req.Body undoes chunked transfer encoding, reading it to the end also consumes the
+	// terminating chunk and trailers so a kept alive connection is at the next request
+	body, err := io.ReadAll(io.LimitReader(req.Body, int64(w.opts.MaxRequestBytes)+1))
+	if err != nil {
+		if limit.slow {
+			return nil, errSlowClient
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return nil, err
+		}
+		// bad chunk framing, or the client stopped sending before the body was complete
+		return nil, fmt.Errorf("%w: %w", errBadBody, err)
+	}
+	if len(body) > w.opts.MaxRequestBytes {
+		return nil, errRequestTooLarge
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return req, nil
+}
+
+// handleExpect answers an Expect: 100-continue header, clients sending it wait for 100 Continue
+// before they send the body. A body over MaxRequestBytes or any other expectation fails with 417
+func (w *WorkerPool) handleExpect(conn net.Conn, req *http.Request) error {
+	expect := req.Header.Get("Expect")
+	if expect == "" || !req.ProtoAtLeast(1, 1) {
+		return nil
+	}
+	if !strings.EqualFold(expect, "100-continue") || req.ContentLength > int64(w.opts.MaxRequestBytes) {
+		return errExpectationFailed
+	}
+	if req.ContentLength == 0 {
+		// nothing to wait for
+		return nil
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(w.opts.WriteTimeout))
+	_, err := conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	return err
+}
+
+// readErrorStatus maps an error from readRequest to the status sent back to the client,
+// 0 means the connection is gone and no response should be written
+func readErrorStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errRequestTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errExpectationFailed):
+		return http.StatusExpectationFailed
+	case errors.Is(err, errHeaderTooLarge):
+		return http.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, errBadBody):
+		return http.StatusBadRequest
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, errSlowClient):
+		// the client was too slow sending the request
+		return http.StatusRequestTimeout
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return 0
+	default:
+		// anything else is a request http.ReadRequest could not parse
+		return http.StatusBadRequest
+	}
+}
+
+// noHeaderLimit is the limit of a requestLimitReader while no headers are being read
+const noHeaderLimit = math.MaxInt64
+
+// requestLimitReader reads from r until n bytes are used up, then reports EOF. Unlike
+// io.LimitReader the limit can be changed between reads, it is lifted while the body is read.
+// Between startRate and stopRate it also fails with errSlowClient once less than minRate
+// bytes per second arrived since startRate, a client sending nothing at all is left to the read deadline
+type requestLimitReader struct {
+	r io.Reader
+	n int64
+
+	minRate int           //bytes per second, 0 disables the check
+	grace   time.Duration //the rate is only checked once this passed since start
+	start   time.Time     //zero while no request is being read
+	read    int64         //bytes read since start
+	slow    bool          //the rate fell below minRate, every read fails until startRate
+}
+
+func (l *requestLimitReader) Read(p []byte) (int, error) {
+	if l.slow {
+		return 0, errSlowClient
+	}
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if err == nil && l.tooSlow(n) {
+		l.slow = true
+		return n, errSlowClient
+	}
+	return n, err
+}
+
+// tooSlow adds n to the bytes read and reports whether they fell below minRate
+func (l *requestLimitReader) tooSlow(n int) bool {
+	if l.minRate <= 0 || l.start.IsZero() {
+		return false
+	}
+	l.read += int64(n)
+	elapsed := time.Since(l.start)
+	return elapsed > l.grace && float64(l.read) < float64(l.minRate)*elapsed.Seconds()
+}
+
+func (l *requestLimitReader) startRate(now time.Time) {
+	l.start, l.read, l.slow = now, 0, false
+}
+
+func (l *requestLimitReader) stopRate() {
+	l.start = time.Time{}
+}
+
+// writeFull writes b to conn until all of it is sent, a short write without an error is
+// retried with the rest. It only fails on a write error, such as the write deadline passing
+func writeFull(conn net.Conn, b []byte) error {
+	for len(b) > 0 {
+		n, err := conn.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// writeErrorResponse sends a response without body, the connection is closed after it
+func (w *WorkerPool) writeErrorResponse(conn net.Conn, status int, headers map[string]string) {
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	conn.Write(w.response(status, headers, nil, false))
+}
+
+// requestID returns the id of req from its RequestIDHeader, generating one and setting it on
+// req when the client didn't send any. It returns "" when request ids are disabled
+func (w *WorkerPool) requestID(req *http.Request) string {
+	if w.opts.RequestIDHeader == "" {
+		return ""
+	}
+	id := req.Header.Get(w.opts.RequestIDHeader)
+	if id == "" {
+		id = fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+		req.Header.Set(w.opts.RequestIDHeader, id)
+	}
+	return id
+}
+
+// withRequestID returns headers with the RequestIDHeader set to id, copied so the handler's
+// map isn't changed. Headers already carrying one, e.g. set by the handler, are kept as is
+func (w *WorkerPool) withRequestID(headers map[string]string, id string) map[string]string {
+	if id == "" || hasHeader(headers, w.opts.RequestIDHeader) {
+		return headers
+	}
+	withID := make(map[string]string, len(headers)+1)
+	for name, value := range headers {
+		withID[name] = value
+	}
+	withID[w.opts.RequestIDHeader] = id
+	return withID
+}
+
+// response is buildResponse with the Server header added when ServerHeader is set,
+// every response of the pool and the server goes through it or headResponse
+func (w *WorkerPool) response(status int, headers map[string]string, body []byte, keepAlive bool) []byte {
+	return w.buildResponse(status, headers, body, keepAlive, false)
+}
+
+// headResponse is response without the body, for a HEAD request
+func (w *WorkerPool) headResponse(status int, headers map[string]string, body []byte, keepAlive bool) []byte {
+	return w.buildResponse(status, headers, body, keepAlive, true)
+}
+
+func (w *WorkerPool) buildResponse(status int, headers map[string]string, body []byte, keepAlive, head bool) []byte {
+	if w.opts.ServerHeader != "" && !hasHeader(headers, "Server") {
+		withServer := make(map[string]string, len(headers)+1)
+		for name, value := range headers {
+			withServer[name] = value
+		}
+		withServer["Server"] = w.opts.ServerHeader
+		headers = withServer
+	}
+	return buildResponse(status, headers, body, keepAlive, head)
+}
+
+// reject serializes r, retryAfter is rounded up to whole seconds and the header is left out when it is 0
+func (w *WorkerPool) reject(r RejectResponse, retryAfter time.Duration) []byte {
+	return w.response(r.Status, r.headers(retryAfter), []byte(r.Body), false)
+}
+
+// SubmitJob puts the job into the channel and idle worker picks up,
+// once the pool is closed the connection is closed without being served
 func (w *WorkerPool) SubmitJob(j Job) {
-	w.JobChan <- j
+	w.sendMutex.RLock()
+	defer w.sendMutex.RUnlock()
+
+	select {
+	case <-w.done:
+		j.Conn.Close()
+		return
+	default:
+	}
+
+	if j.Enqueued.IsZero() {
+		j.Enqueued = time.Now()
+	}
+	// the worker serving the job decrements it, so it is counted before the send like the
+	// accept loop does, a fast worker can't decrement it first
+	w.opts.Metrics.ActiveConnections.Inc()
+	select {
+	case w.JobChan <- j:
+		w.grow()
+	case <-w.done:
+		w.opts.Metrics.ActiveConnections.Dec()
+		j.Conn.Close()
+	}
+}
+
+// Size returns the current number of workers
+func (w *WorkerPool) Size() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.MaxWorkers
+}
+
+// Resize grows or shrinks the pool to n workers. Excess workers exit only after
+// finishing their current job, so shrinking blocks until they are done; jobs
+// already in the channel are left for the remaining workers
+func (w *WorkerPool) Resize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("worker pool needs at least 1 worker, got %d", n)
+	}
+	n = w.opts.limitWorkers(n)
+
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return errors.New("worker pool is closed")
+	}
+
+	if n > w.MaxWorkers {
+		w.spawn(n - w.MaxWorkers)
+	}
+	// with WorkerIdleTimeout fewer than MaxWorkers may be running, only the ones above n are stopped
+	stop := max(w.live-n, 0)
+	w.live -= stop
+	w.MaxWorkers = n
+	w.mutex.Unlock()
+
+	// sent without the mutex so workers retiring at the same time aren't blocked on it
+	for i := 0; i < stop; i++ {
+		w.quit <- struct{}{}
+	}
+	return nil
 }
 
 // Close closes the channel and wait for all the workers to finish
 func (w *WorkerPool) Close() {
-	close(w.JobChan)
+	w.draining.Store(true)
+
+	w.mutex.Lock()
+	first := !w.closed
+	w.closed = true
+	w.mutex.Unlock()
+
+	if first {
+		// senders waiting for queue space give up, then the write lock waits for the ones
+		// still sending. New sends see done closed, so JobChan can be closed safely
+		close(w.done)
+		w.sendMutex.Lock()
+		close(w.JobChan)
+		w.sendMutex.Unlock()
+	}
+
 	w.wg.Wait()
 }
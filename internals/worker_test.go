@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/atharvamhaske/tcpie/internals/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// connPair returns both ends of a TCP connection over loopback, closed when the test ends
+func connPair(t *testing.T) (server, client net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+// newTestPool starts a pool of workers with opts, closed when the test ends
+func newTestPool(t *testing.T, workers int, opts WorkerOpts) *WorkerPool {
+	t.Helper()
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.DiscardHandler)
+	}
+	// unregistered, so the counters only see this pool
+	opts.Metrics = metrics.ServerMetrics{}
+	opts.Metrics.CreateMetrics(nil)
+	pool := NewWorkerPool(workers, 1, opts)
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatalf("reading counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestWorkerSurvivesPanic(t *testing.T) {
+	tests := []struct {
+		name  string
+		panic func()
+	}{
+		{name: "string", panic: func() { panic("boom") }},
+		{name: "error", panic: func() { panic(errors.New("boom")) }},
+		{name: "nil dereference", panic: func() {
+			var req *http.Request
+			_ = req.URL
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a single worker, the second job is only served if it survived the first
+			pool := newTestPool(t, 1, WorkerOpts{Handler: func(req *http.Request) (int, map[string]string, []byte) {
+				if req.URL.Path == "/panic" {
+					tt.panic()
+				}
+				return http.StatusOK, nil, []byte("ok")
+			}})
+
+			server, client := connPair(t)
+			pool.SubmitJob(Job{Id: 1, Conn: server})
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(client, "GET /panic HTTP/1.1\r\nHost: test\r\n\r\n")
+			// the connection of the panicking request is closed without a response
+			if n, err := client.Read(make([]byte, 1)); err == nil {
+				t.Fatalf("read %d bytes from the panicking request, want the connection closed", n)
+			}
+
+			server, client = connPair(t)
+			pool.SubmitJob(Job{Id: 2, Conn: server})
+			resp, body := get(t, client, bufio.NewReader(client), "/")
+			if resp.StatusCode != http.StatusOK || body != "ok" {
+				t.Errorf("next job got %d %q, want 200 %q", resp.StatusCode, body, "ok")
+			}
+
+			if got := counterValue(t, pool.opts.Metrics.Panics); got != 1 {
+				t.Errorf("worker_panics_total = %g, want 1", got)
+			}
+			if got := pool.Alive(); got != 1 {
+				t.Errorf("Alive() = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	const first = "POST /first HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello"
+	const second = "GET /second HTTP/1.1\r\nHost: test\r\n\r\n"
+	tests := []struct {
+		name           string
+		readBufferSize int
+		writes         []string
+	}{
+		{name: "one write", writes: []string{first + second}},
+		{name: "split inside the first body", writes: []string{first[:len(first)-2], first[len(first)-2:] + second}},
+		{name: "split inside the second headers", writes: []string{first + second[:10], second[10:]}},
+		{name: "reads smaller than a request", readBufferSize: 8, writes: []string{first + second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(t, 1, WorkerOpts{
+				KeepAlive:      true,
+				ReadBufferSize: tt.readBufferSize,
+				Handler: func(req *http.Request) (int, map[string]string, []byte) {
+					body, _ := io.ReadAll(req.Body)
+					return http.StatusOK, nil, append([]byte(req.URL.Path+" "), body...)
+				},
+			})
+
+			server, client := connPair(t)
+			pool.SubmitJob(Job{Id: 1, Conn: server})
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			for _, w := range tt.writes {
+				if _, err := io.WriteString(client, w); err != nil {
+					t.Fatalf("writing request: %v", err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			reader := bufio.NewReader(client)
+			for _, want := range []string{"/first hello", "/second "} {
+				resp, body := readResponse(t, reader)
+				if resp.StatusCode != http.StatusOK || body != want {
+					t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, want)
+				}
+			}
+		})
+	}
+}